@@ -0,0 +1,197 @@
+package gouncer
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// validRights are the rights gouncer hands out on systems
+var validRights = map[string]bool{"read": true, "create": true, "update": true, "delete": true, "admin": true}
+
+// privateUserFields never leave gouncer
+var privateUserFields = []string{"password", "salt", "hash", "restore_code"}
+
+// Admin is the base of the administration endpoints. Callers need the admin right on the admin system.
+type Admin struct {
+	Authorizer
+	*Core
+	*MailConfig
+	*PasswordPolicy
+}
+
+// authenticate validates the credentials of the caller
+func (a *Admin) authenticate() bool {
+	err := a.ParseAuthHeader(a.HttpRequest.Header.Get("Authorization"))
+
+	if err == nil {
+		var valid bool
+		if valid, err = a.ValidCredentials(); valid && a.Impersonated() {
+			// Impersonation tokens can't be used to administer other accounts
+			a.NewError(http.StatusForbidden, "Impersonation tokens can't be used for administration")
+			return false
+		} else if valid {
+			return true
+		} else if err == nil {
+			err = errors.New("Invalid credentials")
+		}
+	}
+
+	a.NewError(http.StatusUnauthorized, err.Error())
+	return false
+}
+
+// authorize validates the credentials of the caller and checks for the admin right
+func (a *Admin) authorize() bool {
+	if !a.authenticate() {
+		return false
+	}
+
+	if !a.IsAdmin(a.AdminSystem) {
+		a.NewError(http.StatusForbidden, "This endpoint requires the admin right on "+a.AdminSystem)
+		return false
+	}
+
+	return true
+}
+
+// pathArgs returns the unescaped path segments after the prefix
+func (a *Admin) pathArgs(prefix string) []string {
+	var args []string
+
+	for _, seg := range strings.Split(strings.Trim(strings.TrimPrefix(a.HttpRequest.URL.Path, prefix), "/"), "/") {
+		if arg, err := url.PathUnescape(seg); err == nil && arg != "" {
+			args = append(args, arg)
+		}
+	}
+
+	return args
+}
+
+// audit records the administrative action on the owner
+func (a *Admin) audit(action string, owner string, err error) {
+	event := NewAuditEvent("admin", a.HttpRequest)
+	event.Action = action
+	event.Owner = owner
+	a.MarkActor(event)
+	event.Success = err == nil
+
+	if err != nil {
+		event.Error = err.Error()
+	}
+
+	a.Audit(event)
+}
+
+// PublicUser returns a copy of the user document without password data
+func PublicUser(user map[string]interface{}) map[string]interface{} {
+	public := make(map[string]interface{})
+
+	for k, v := range user {
+		public[k] = v
+	}
+
+	for _, field := range privateUserFields {
+		delete(public, field)
+	}
+
+	return public
+}
+
+// ValidateSystems checks that every system entry has an absolute uri and only known rights
+func ValidateSystems(systems []interface{}) error {
+	for _, s := range systems {
+		system, ok := s.(map[string]interface{})
+		if !ok {
+			return errors.New("System entries have to be objects with a uri and rights")
+		}
+
+		uri, _ := system["uri"].(string)
+		if u, err := url.Parse(uri); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return errors.New("Invalid system uri: " + uri)
+		}
+
+		rights, ok := system["rights"].([]interface{})
+		if !ok || len(rights) == 0 {
+			return errors.New("System " + uri + " requires a list of rights")
+		}
+
+		for _, right := range rights {
+			if r, ok := right.(string); !ok || !validRights[r] {
+				return errors.New("Unknown right on " + uri)
+			}
+		}
+
+		if keyRights, exists := system["key_rights"]; exists {
+			list, _ := keyRights.([]interface{})
+			for _, right := range list {
+				if r, ok := right.(string); !ok || !containsRight(rights, r) {
+					return errors.New("Key rights on " + uri + " have to be a subset of its rights")
+				}
+			}
+		}
+
+		if policy, exists := system["policy"]; exists {
+			expr, ok := policy.(string)
+			if !ok {
+				return errors.New("The policy on " + uri + " has to be a string")
+			}
+
+			if expr != "" {
+				if _, err := CompilePolicy(expr); err != nil {
+					return errors.New("Invalid policy on " + uri + ": " + err.Error())
+				}
+			}
+		}
+
+		if field := invalidGrantTime(system); field != "" {
+			return errors.New("Invalid " + field + " on " + uri)
+		}
+	}
+
+	return nil
+}
+
+// ValidateMemberships checks that every group membership refers to an existing group and has valid timestamps
+func (a *Admin) ValidateMemberships(groups []interface{}) error {
+	for _, g := range groups {
+		var id string
+
+		switch membership := g.(type) {
+		case string:
+			id = membership
+		case map[string]interface{}:
+			id, _ = membership["id"].(string)
+		}
+
+		if id == "" {
+			return errors.New("Group memberships have to be group ids or objects with an id")
+		}
+
+		if membership, ok := g.(map[string]interface{}); ok {
+			if field := invalidGrantTime(membership); field != "" {
+				return errors.New("Invalid " + field + " on the membership of " + id)
+			}
+		}
+
+		if _, err := a.FetchGroup(id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// invalidGrantTime returns the first validity timestamp of the grant that can't be parsed
+func invalidGrantTime(grant map[string]interface{}) string {
+	for _, field := range []string{"not_before", "not_after"} {
+		if value, exists := grant[field]; exists {
+			if _, ok := parseGrantTime(value); !ok {
+				return field
+			}
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,522 @@
+package gouncer
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// GroupAdmin manages groups and their members through /admin/groups. Besides admins the owners
+// of a group can manage its members and narrow down its systems.
+type GroupAdmin struct {
+	Admin
+	delegated bool // Set when the caller acts as group owner instead of admin
+}
+
+// GroupRequest holds the group details submitted to the group endpoints
+type GroupRequest struct {
+	Id          string        `json:"id,omitempty"`
+	Name        string        `json:"name,omitempty"`
+	Description string        `json:"description,omitempty"`
+	Systems     []interface{} `json:"systems"`
+	Owners      []string      `json:"owners,omitempty"`
+}
+
+// MembersRequest holds the members to add to or remove from a group
+type MembersRequest struct {
+	Members   []string `json:"members"`
+	NotBefore string   `json:"not_before,omitempty"` // Optional validity period of added memberships
+	NotAfter  string   `json:"not_after,omitempty"`
+}
+
+// MemberResult is the outcome of a bulk membership change for a single user
+type MemberResult struct {
+	Email   string `json:"email" xml:"email,attr"`
+	Success bool   `json:"success" xml:"success,attr"`
+	Error   string `json:"error,omitempty" xml:",omitempty"`
+}
+
+func NewGroupAdmin(h *ResponseHandler) *GroupAdmin {
+	return &GroupAdmin{Admin: Admin{Authorizer: Authorizer{ResponseHandler: h}}}
+}
+
+// HandleRequest checks the admin or owner rights and routes the request. Owners can list and read
+// their groups, manage the members and update a group within the systems it already defines.
+//
+//	GET    /admin/groups               List groups
+//	POST   /admin/groups               Create a group
+//	GET    /admin/groups/<id>          Read a group
+//	PUT    /admin/groups/<id>          Update a group
+//	DELETE /admin/groups/<id>          Delete a group and its memberships
+//	GET    /admin/groups/<id>/members  List the members
+//	POST   /admin/groups/<id>/members  Add members in bulk
+//	DELETE /admin/groups/<id>/members  Remove members in bulk
+func (g *GroupAdmin) HandleRequest() {
+	args := g.pathArgs("/admin/groups")
+	method := g.HttpRequest.Method
+
+	if !g.authenticate() {
+		return
+	}
+
+	if !g.IsAdmin(g.AdminSystem) {
+		if !g.ownerRequest(args, method) {
+			g.NewError(http.StatusForbidden, "This endpoint requires the admin right or ownership of the group")
+			return
+		}
+
+		g.delegated = true
+	}
+
+	switch {
+	case len(args) == 0 && method == "GET":
+		g.List()
+	case len(args) == 0 && method == "POST":
+		g.Create()
+	case len(args) == 1 && method == "GET":
+		g.Read(args[0])
+	case len(args) == 1 && method == "PUT":
+		g.Update(args[0])
+	case len(args) == 1 && method == "DELETE":
+		g.Delete(args[0])
+	case len(args) == 2 && args[1] == "members" && method == "GET":
+		g.Members(args[0])
+	case len(args) == 2 && args[1] == "members" && (method == "POST" || method == "DELETE"):
+		g.ChangeMembers(args[0], method == "POST")
+	default:
+		g.NewError(http.StatusNotFound, "Unknown group administration request")
+	}
+}
+
+// ownerRequest checks if the request is open to group owners and the caller owns the group
+func (g *GroupAdmin) ownerRequest(args []string, method string) bool {
+	switch {
+	case len(args) == 0:
+		return method == "GET"
+	case method == "POST" && len(args) == 1, method == "DELETE" && len(args) == 1:
+		return false
+	}
+
+	return g.OwnsGroups(args[:1])
+}
+
+// List responds with all groups. Owners only get the groups they own.
+func (g *GroupAdmin) List() {
+	var groups []interface{}
+	var err error
+
+	couch := NewCouch(g.Couchdb, g.Groupdb)
+
+	if g.delegated {
+		groups, err = couch.Find(map[string]interface{}{"owners": map[string]interface{}{"$elemMatch": map[string]interface{}{"$eq": g.Username}}})
+	} else {
+		groups, err = couch.AllDocs()
+	}
+
+	if err != nil {
+		g.NewError(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	g.Response.Status = http.StatusOK
+	g.Response.Groups = groups
+}
+
+// Create adds a new group
+func (g *GroupAdmin) Create() {
+	var req GroupRequest
+
+	if err := DecodeJsonRequest(g.HttpRequest.Body, &req); err != nil {
+		g.NewError(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if req.Id == "" || strings.HasPrefix(req.Id, "_") || strings.Contains(req.Id, "/") {
+		g.NewError(http.StatusBadRequest, "A group requires an id that doesn't start with _ or contain /")
+		return
+	}
+
+	if _, err := g.FetchGroup(req.Id); err == nil {
+		g.NewError(http.StatusConflict, "This group already exists.")
+		return
+	}
+
+	group := map[string]interface{}{"_id": req.Id, "systems": []interface{}{}}
+
+	if err := g.apply(group, req); err != nil {
+		g.NewError(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	err := g.save(group)
+	g.auditGroup("create group", req.Id, "", err)
+
+	if err != nil {
+		g.NewError(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	g.Response.Status = http.StatusCreated
+	g.Response.Groups = group
+}
+
+// Read responds with the group
+func (g *GroupAdmin) Read(id string) {
+	if group := g.fetch(id); group != nil {
+		g.Response.Status = http.StatusOK
+		g.Response.Groups = group
+	}
+}
+
+// Update replaces the name, description, systems and owners of the group
+func (g *GroupAdmin) Update(id string) {
+	var req GroupRequest
+
+	if err := DecodeJsonRequest(g.HttpRequest.Body, &req); err != nil {
+		g.NewError(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	group := g.fetch(id)
+	if group == nil {
+		return
+	}
+
+	if err := g.apply(group, req); err != nil {
+		g.NewError(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	err := g.save(group)
+	g.auditGroup("update group", id, "", err)
+
+	if err != nil {
+		g.NewError(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	g.Response.Status = http.StatusOK
+	g.Response.Groups = group
+}
+
+// Delete removes the group and the memberships referring to it
+func (g *GroupAdmin) Delete(id string) {
+	if g.fetch(id) == nil {
+		return
+	}
+
+	members, err := GroupMembers(g.Backend, id)
+
+	if err == nil {
+		for _, member := range members {
+			user := member.(map[string]interface{})
+			user["groups"], _ = removeMembership(user["groups"], id)
+
+			if serr := g.saveUser(user); serr != nil {
+				g.Logger.Println("ADMIN GROUPS:", user["email"], serr)
+			}
+		}
+
+		_, err = NewCouch(g.Couchdb, g.Groupdb).Delete(id)
+	}
+
+	g.auditGroup("delete group", id, "", err)
+
+	if err != nil {
+		g.NewError(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	g.NewResponse(http.StatusOK, "The group "+id+" was deleted.")
+}
+
+// Members responds with the users that are a member of the group
+func (g *GroupAdmin) Members(id string) {
+	if g.fetch(id) == nil {
+		return
+	}
+
+	members, err := GroupMembers(g.Backend, id)
+
+	if err != nil {
+		g.NewError(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	var users []interface{}
+	seen := make(map[interface{}]bool)
+
+	for _, member := range members {
+		user := member.(map[string]interface{})
+		if seen[user["_id"]] {
+			continue
+		}
+
+		seen[user["_id"]] = true
+		users = append(users, map[string]interface{}{"email": user["email"], "name": user["name"], "active": user["active"]})
+	}
+
+	g.Response.Status = http.StatusOK
+	g.Response.Users = users
+}
+
+// ChangeMembers adds or removes the members in the request and responds with the outcome per user
+func (g *GroupAdmin) ChangeMembers(id string, add bool) {
+	var req MembersRequest
+
+	if err := DecodeJsonRequest(g.HttpRequest.Body, &req); err != nil {
+		g.NewError(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if g.fetch(id) == nil {
+		return
+	}
+
+	var membership interface{} = id
+
+	if req.NotBefore != "" || req.NotAfter != "" {
+		grant := map[string]interface{}{"id": id}
+
+		for field, value := range map[string]string{"not_before": req.NotBefore, "not_after": req.NotAfter} {
+			if value == "" {
+				continue
+			}
+
+			if _, ok := parseGrantTime(value); !ok {
+				g.NewError(http.StatusBadRequest, "Invalid "+field)
+				return
+			}
+
+			grant[field] = value
+		}
+
+		membership = grant
+	}
+
+	var results []MemberResult
+
+	for _, email := range req.Members {
+		err := g.changeMember(strings.ToLower(strings.TrimSpace(email)), id, membership, add)
+		result := MemberResult{Email: email, Success: err == nil}
+
+		if err != nil {
+			result.Error = err.Error()
+		}
+
+		if add {
+			g.auditGroup("add member", id, email, err)
+		} else {
+			g.auditGroup("remove member", id, email, err)
+		}
+
+		results = append(results, result)
+	}
+
+	g.Response.Status = http.StatusOK
+	g.Response.Users = results
+}
+
+func (g *GroupAdmin) changeMember(email string, id string, membership interface{}, add bool) error {
+	user, err := FetchUserByEmail(g.Backend, email)
+	if err != nil {
+		return errors.New("Unknown user")
+	}
+
+	groups, removed := removeMembership(user["groups"], id)
+
+	if add {
+		groups = append(groups, membership)
+	} else if !removed {
+		return errors.New("Not a member of this group")
+	}
+
+	user["groups"] = groups
+	return g.saveUser(user)
+}
+
+// apply validates the request and copies it onto the group document. Owners can't change the owners
+// and can't grant systems or rights beyond what the group already defines.
+func (g *GroupAdmin) apply(group map[string]interface{}, req GroupRequest) error {
+	if err := ValidateSystems(req.Systems); err != nil {
+		return err
+	}
+
+	if g.delegated {
+		if req.Owners != nil {
+			return errors.New("Only admins can change the owners of a group")
+		}
+
+		current, _ := group["systems"].([]interface{})
+		if err := withinSystems(req.Systems, current); err != nil {
+			return err
+		}
+	}
+
+	for _, owner := range req.Owners {
+		if _, err := EmailDomain(owner); err != nil {
+			return errors.New("Invalid owner: " + owner)
+		}
+	}
+
+	if req.Systems != nil {
+		group["systems"] = req.Systems
+	}
+
+	if req.Name != "" {
+		group["name"] = req.Name
+	}
+
+	if req.Description != "" {
+		group["description"] = req.Description
+	}
+
+	if req.Owners != nil {
+		owners := make([]interface{}, len(req.Owners))
+		for i, owner := range req.Owners {
+			owners[i] = strings.ToLower(owner)
+		}
+
+		group["owners"] = owners
+	}
+
+	return nil
+}
+
+// fetch loads the group or responds with a not found error
+func (g *GroupAdmin) fetch(id string) map[string]interface{} {
+	group, err := g.FetchGroup(id)
+
+	if err != nil {
+		g.NewError(http.StatusNotFound, err.Error())
+		return nil
+	}
+
+	return group
+}
+
+func (g *GroupAdmin) save(group map[string]interface{}) error {
+	doc, err := json.Marshal(group)
+
+	if err == nil {
+		_, err = NewCouch(g.Couchdb, g.Groupdb).Post(doc)
+	}
+
+	return err
+}
+
+func (g *GroupAdmin) saveUser(user map[string]interface{}) error {
+	doc, err := json.Marshal(user)
+
+	if err == nil {
+		_, err = NewCouch(g.Couchdb, g.Userdb).Post(doc)
+	}
+
+	return err
+}
+
+// auditGroup records the action on the group. The group is kept as system and the affected member as owner.
+func (g *GroupAdmin) auditGroup(action string, id string, owner string, err error) {
+	event := NewAuditEvent("admin", g.HttpRequest)
+	event.Action = action
+	event.System = "group:" + id
+	event.Owner = owner
+	g.MarkActor(event)
+	event.Success = err == nil
+
+	if err != nil {
+		event.Error = err.Error()
+	}
+
+	g.Audit(event)
+}
+
+// withinSystems checks that every requested system is defined in the current systems with at least the
+// requested rights and key rights, the same policy and a validity period within the current one
+func withinSystems(requested []interface{}, current []interface{}) error {
+	for _, r := range requested {
+		system := r.(map[string]interface{})
+		var defined map[string]interface{}
+
+		for _, c := range current {
+			if sys, ok := c.(map[string]interface{}); ok && sys["uri"] == system["uri"] {
+				defined = sys
+			}
+		}
+
+		uri, _ := system["uri"].(string)
+		if defined == nil {
+			return errors.New("The group doesn't define " + uri)
+		}
+
+		for _, right := range system["rights"].([]interface{}) {
+			if !containsRight(defined["rights"], right.(string)) {
+				return errors.New("The group doesn't grant the " + right.(string) + " right on " + uri)
+			}
+		}
+
+		// Policies restrict access so they have to stay as the admin defined them
+		policy, _ := system["policy"].(string)
+		if current, _ := defined["policy"].(string); policy != current {
+			return errors.New("The policy of " + uri + " can only be changed by admins")
+		}
+
+		for _, right := range keyRights(system) {
+			if !containsRight(keyRights(defined), right.(string)) {
+				return errors.New("The group doesn't grant the " + right.(string) + " key right on " + uri)
+			}
+		}
+
+		// The validity period can only be narrowed down
+		if limit, limited := parseGrantTime(defined["not_before"]); limited {
+			if nb, ok := parseGrantTime(system["not_before"]); !ok || nb.Before(limit) {
+				return errors.New("The not_before of " + uri + " can't be earlier than the group defines")
+			}
+		}
+
+		if limit, limited := parseGrantTime(defined["not_after"]); limited {
+			if na, ok := parseGrantTime(system["not_after"]); !ok || na.After(limit) {
+				return errors.New("The not_after of " + uri + " can't be later than the group defines")
+			}
+		}
+	}
+
+	return nil
+}
+
+// keyRights returns the rights read keys for the system entry grant. Entries without key_rights grant read.
+func keyRights(system map[string]interface{}) []interface{} {
+	if rights, exists := system["key_rights"].([]interface{}); exists {
+		return rights
+	}
+
+	return []interface{}{"read"}
+}
+
+// removeMembership drops every membership of the group from the memberships list
+func removeMembership(memberships interface{}, id string) ([]interface{}, bool) {
+	var kept = []interface{}{}
+	var removed bool
+
+	list, _ := memberships.([]interface{})
+
+	for _, m := range list {
+		switch membership := m.(type) {
+		case string:
+			if membership == id {
+				removed = true
+				continue
+			}
+		case map[string]interface{}:
+			if membership["id"] == id {
+				removed = true
+				continue
+			}
+		}
+
+		kept = append(kept, m)
+	}
+
+	return kept, removed
+}
@@ -0,0 +1,417 @@
+package gouncer
+
+import (
+	"crypto"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 1000
+)
+
+// UserAdmin manages user accounts through /admin/users
+type UserAdmin struct {
+	Admin
+}
+
+// AdminUserRequest holds the account details submitted by an admin
+type AdminUserRequest struct {
+	Email    string        `json:"email"`
+	Name     string        `json:"name,omitempty"`
+	Password string        `json:"password,omitempty"` // Without a password the user receives a reset mail
+	Active   *bool         `json:"active,omitempty"`   // Defaults to true
+	Groups   []interface{} `json:"groups,omitempty"`
+	Systems  []interface{} `json:"systems,omitempty"`
+	Link     string        `json:"link,omitempty"` // Reset link for the password reset mail
+}
+
+func NewUserAdmin(h *ResponseHandler) *UserAdmin {
+	return &UserAdmin{Admin{Authorizer: Authorizer{ResponseHandler: h}}}
+}
+
+// HandleRequest checks the admin right and routes the request
+//
+//	GET    /admin/users                     List users (limit, skip, q, active, group)
+//	POST   /admin/users                     Create a user
+//	GET    /admin/users/<email>             Read a user
+//	PUT    /admin/users/<email>             Update name, active, groups and systems
+//	DELETE /admin/users/<email>             Delete a user
+//	POST   /admin/users/<email>/deactivate  Deactivate a user and revoke the sessions
+//	POST   /admin/users/<email>/reactivate  Reactivate a user
+//	POST   /admin/users/<email>/reset       Mail a password reset code to the user
+//	PUT    /admin/users/<email>/groups      Replace the group memberships
+//	PUT    /admin/users/<email>/systems     Replace the per user systems
+func (u *UserAdmin) HandleRequest() {
+	if !u.authorize() {
+		return
+	}
+
+	args := u.pathArgs("/admin/users")
+	method := u.HttpRequest.Method
+
+	switch {
+	case len(args) == 0 && method == "GET":
+		u.List()
+	case len(args) == 0 && method == "POST":
+		u.Create()
+	case len(args) == 1 && method == "GET":
+		u.Read(args[0])
+	case len(args) == 1 && method == "PUT":
+		u.Update(args[0], nil)
+	case len(args) == 1 && method == "DELETE":
+		u.Delete(args[0])
+	case len(args) == 2 && method == "POST" && (args[1] == "deactivate" || args[1] == "reactivate"):
+		u.SetActive(args[0], args[1] == "reactivate")
+	case len(args) == 2 && method == "POST" && args[1] == "reset":
+		u.Reset(args[0])
+	case len(args) == 2 && method == "PUT" && (args[1] == "groups" || args[1] == "systems"):
+		u.Update(args[0], []string{args[1]})
+	default:
+		u.NewError(http.StatusNotFound, "Unknown user administration request")
+	}
+}
+
+// List responds with a page of users matching the filters
+func (u *UserAdmin) List() {
+	query := u.HttpRequest.URL.Query()
+	selector := map[string]interface{}{"email": map[string]interface{}{"$exists": true}}
+
+	if q := query.Get("q"); q != "" {
+		selector["email"] = map[string]interface{}{"$regex": "(?i)" + regexp.QuoteMeta(q)}
+	}
+
+	if active := query.Get("active"); active != "" {
+		selector["active"] = active == "true"
+	}
+
+	if group := query.Get("group"); group != "" {
+		selector["$or"] = []interface{}{
+			map[string]interface{}{"groups": map[string]interface{}{"$elemMatch": map[string]interface{}{"$eq": group}}},
+			map[string]interface{}{"groups": map[string]interface{}{"$elemMatch": map[string]interface{}{"id": group}}},
+		}
+	}
+
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = defaultPageSize
+	}
+
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+
+	skip, _ := strconv.Atoi(query.Get("skip"))
+	if skip < 0 {
+		skip = 0
+	}
+
+	docs, err := NewCouch(u.Couchdb, u.Userdb).Query(selector, limit, skip)
+
+	if err != nil {
+		u.NewError(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	var users []interface{}
+	for _, doc := range docs {
+		users = append(users, PublicUser(doc.(map[string]interface{})))
+	}
+
+	u.Response.Status = http.StatusOK
+	u.Response.Users = users
+}
+
+// Create adds a new account. Accounts created without a password receive a password reset mail.
+func (u *UserAdmin) Create() {
+	var req AdminUserRequest
+
+	if err := DecodeJsonRequest(u.HttpRequest.Body, &req); err != nil {
+		u.NewError(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	req.Email = strings.ToLower(strings.TrimSpace(req.Email))
+
+	if _, err := EmailDomain(req.Email); err != nil {
+		u.NewError(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if exists, err := UserExists(u.Backend, req.Email); exists {
+		u.NewError(http.StatusConflict, "This user already exists.")
+		return
+	} else if err != nil {
+		u.NewError(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if err := u.validate(req.Groups, req.Systems); err != nil {
+		u.NewError(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	sendReset := req.Password == ""
+	if sendReset {
+		req.Password = randomHex(32)
+	} else if err := u.CheckPassword(req.Password); err != nil {
+		u.NewError(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	creds := &Credentials{Backend: u.Backend, HashAlg: crypto.SHA512, Password: req.Password}
+	creds.Salt = creds.CharSalt(64)
+
+	user := map[string]interface{}{
+		"_id":      NewUserID(),
+		"email":    req.Email,
+		"name":     req.Name,
+		"password": creds.PasswordHash(),
+		"salt":     creds.Salt,
+		"hash":     "sha512",
+		"active":   req.Active == nil || *req.Active,
+	}
+
+	if req.Groups != nil {
+		user["groups"] = req.Groups
+	}
+
+	if req.Systems != nil {
+		user["systems"] = req.Systems
+	}
+
+	err := u.save(user)
+
+	// Registrations or address changes might have claimed the address in the meantime
+	if err == nil {
+		if err = ClaimEmail(u.Backend, req.Email, user["_id"].(string)); err != nil {
+			if _, derr := NewCouch(u.Couchdb, u.Userdb).Delete(user["_id"].(string)); derr != nil {
+				u.Logger.Println("ADMIN USERS:", derr)
+			}
+		}
+	}
+
+	u.audit("create", req.Email, err)
+
+	if err == errUserExists {
+		u.NewError(http.StatusConflict, err.Error())
+		return
+	}
+
+	if err != nil {
+		u.NewError(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if sendReset {
+		if err = u.sendReset(req.Email, req.Link); err != nil {
+			u.Logger.Println("ADMIN USERS:", err)
+		}
+	}
+
+	u.Response.Status = http.StatusCreated
+	u.Response.Users = PublicUser(user)
+}
+
+// Read responds with the account
+func (u *UserAdmin) Read(email string) {
+	if user := u.fetch(email); user != nil {
+		u.Response.Status = http.StatusOK
+		u.Response.Users = PublicUser(user)
+	}
+}
+
+// Update changes the name, active state, groups and systems of the account. When fields is set
+// only those fields are taken from the request.
+func (u *UserAdmin) Update(email string, fields []string) {
+	var req = make(map[string]interface{})
+
+	if err := DecodeJsonRequest(u.HttpRequest.Body, &req); err != nil {
+		u.NewError(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	user := u.fetch(email)
+	if user == nil {
+		return
+	}
+
+	if fields == nil {
+		fields = []string{"name", "active", "groups", "systems"}
+	}
+
+	var groups, systems []interface{}
+
+	for _, field := range fields {
+		value, exists := req[field]
+		if !exists {
+			continue
+		}
+
+		var ok bool
+		switch field {
+		case "name":
+			_, ok = value.(string)
+		case "active":
+			_, ok = value.(bool)
+		case "groups":
+			groups, ok = value.([]interface{})
+		case "systems":
+			systems, ok = value.([]interface{})
+		}
+
+		if !ok && value != nil {
+			u.NewError(http.StatusBadRequest, "Invalid value for "+field)
+			return
+		}
+
+		if value == nil {
+			delete(user, field)
+		} else {
+			user[field] = value
+		}
+	}
+
+	if err := u.validate(groups, systems); err != nil {
+		u.NewError(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	err := u.save(user)
+	u.audit("update", email, err)
+
+	if err != nil {
+		u.NewError(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if user["active"] != true {
+		(&Credentials{Backend: u.Backend, Username: email}).RevokeSessions()
+	}
+
+	u.Response.Status = http.StatusOK
+	u.Response.Users = PublicUser(user)
+}
+
+// SetActive deactivates or reactivates the account. Deactivation revokes the sessions of the user,
+// reactivation also lifts a pending approval or cancellation.
+func (u *UserAdmin) SetActive(email string, active bool) {
+	user := u.fetch(email)
+	if user == nil {
+		return
+	}
+
+	user["active"] = active
+
+	if active {
+		for _, field := range []string{"status", "deletion_date", "restore_code"} {
+			delete(user, field)
+		}
+	}
+
+	err := u.save(user)
+
+	if active {
+		u.audit("reactivate", email, err)
+	} else {
+		u.audit("deactivate", email, err)
+	}
+
+	if err != nil {
+		u.NewError(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if !active {
+		(&Credentials{Backend: u.Backend, Username: email}).RevokeSessions()
+	}
+
+	u.Response.Status = http.StatusOK
+	u.Response.Users = PublicUser(user)
+}
+
+// Delete removes the account with its sessions and api keys
+func (u *UserAdmin) Delete(email string) {
+	user := u.fetch(email)
+	if user == nil {
+		return
+	}
+
+	err := DeleteAccount(u.Backend, user["_id"].(string), email)
+	u.audit("delete", email, err)
+
+	if err != nil {
+		u.NewError(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	u.NewResponse(http.StatusOK, "The account for "+email+" was deleted.")
+}
+
+// Reset mails a password reset code to the user
+func (u *UserAdmin) Reset(email string) {
+	var req AdminUserRequest
+	DecodeJsonRequest(u.HttpRequest.Body, &req)
+
+	if u.fetch(email) == nil {
+		return
+	}
+
+	err := u.sendReset(email, req.Link)
+	u.audit("reset", email, err)
+
+	if err != nil {
+		u.NewError(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	u.NewResponse(http.StatusOK, "A password reset mail was sent to "+email)
+}
+
+// fetch loads the account or responds with a not found error
+func (u *UserAdmin) fetch(email string) map[string]interface{} {
+	user, err := FetchUserByEmail(u.Backend, email)
+
+	if err != nil {
+		u.NewError(http.StatusNotFound, "Unknown user: "+email)
+		return nil
+	}
+
+	return user
+}
+
+func (u *UserAdmin) validate(groups []interface{}, systems []interface{}) error {
+	if err := u.ValidateMemberships(groups); err != nil {
+		return err
+	}
+
+	return ValidateSystems(systems)
+}
+
+func (u *UserAdmin) save(user map[string]interface{}) error {
+	doc, err := json.Marshal(user)
+
+	if err == nil {
+		_, err = NewCouch(u.Couchdb, u.Userdb).Post(doc)
+	}
+
+	return err
+}
+
+func (u *UserAdmin) sendReset(email string, link string) error {
+	if u.Smtp == "" || u.MailConfig == nil {
+		return errors.New("Password reset mails require an smtp server")
+	}
+
+	if link != "" && !(&Mail{MailConfig: u.MailConfig}).allowedDomain(link) {
+		return errors.New("Reset link does not appear on the whitelist")
+	}
+
+	recovery := &PasswordRecovery{Credentials: Credentials{Backend: u.Backend, Username: email}, Core: u.Core, MailConfig: u.MailConfig}
+	return recovery.SendResetCode(link)
+}
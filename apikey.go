@@ -0,0 +1,373 @@
+package gouncer
+
+import (
+	"crypto"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	apiKeyPrefix = "pk." // Prefix separating persistent api keys from ephemeral read keys
+)
+
+var (
+	errApiKeyInvalid       = errors.New("Invalid api key")
+	errApiKeyRevoked       = errors.New("This api key has been revoked")
+	errApiKeyExpired       = errors.New("This api key has expired")
+	errApiKeyOwnerInactive = errors.New("The owner of this api key is no longer active")
+)
+
+// ApiKeyHandler manages the persistent api keys of the authenticated user
+type ApiKeyHandler struct {
+	Authorizer
+}
+
+// ApiKeyRequest holds the settings for a new api key
+type ApiKeyRequest struct {
+	Name        string   `json:"name"`
+	Systems     []string `json:"systems"`
+	Rights      []string `json:"rights,omitempty"`       // Defaults to read
+	Expires     string   `json:"expires,omitempty"`      // RFC3339 timestamp. Keys without expiry live until revoked
+	Quota       int      `json:"quota,omitempty"`        // Requests allowed per quota period. Overrides the server default
+	QuotaPeriod int32    `json:"quota_period,omitempty"` // Quota period in seconds
+}
+
+// ApiKey is the api key document stored in the key database. The key itself is only
+// returned on creation. The database only holds a salted hash.
+type ApiKey struct {
+	Id          string   `json:"_id"`
+	Rev         string   `json:"_rev,omitempty"`
+	Name        string   `json:"name"`
+	Owner       string   `json:"owner"`
+	OwnerID     string   `json:"owner_id,omitempty"` // Stable user id of the owner
+	Systems     []string `json:"systems"`
+	Rights      []string `json:"rights"`
+	Created     string   `json:"created"`
+	Expires     string   `json:"expires,omitempty"`
+	Revoked     string   `json:"revoked,omitempty"`
+	Quota       int      `json:"quota,omitempty"`
+	QuotaPeriod int32    `json:"quota_period,omitempty"`
+	Hash        string   `json:"hash,omitempty"`
+	Salt        string   `json:"salt,omitempty"`
+	Key         string   `json:"key,omitempty"` // Only set in the creation response
+}
+
+func NewApiKeyHandler(h *ResponseHandler) *ApiKeyHandler {
+	return &ApiKeyHandler{Authorizer: Authorizer{ResponseHandler: h}}
+}
+
+// HandleRequest validates the credentials and delegates to the method specific handler
+func (a *ApiKeyHandler) HandleRequest() {
+	err := a.ParseAuthHeader(a.HttpRequest.Header.Get("Authorization"))
+
+	if err == nil {
+		var valid bool
+		if valid, err = a.ValidCredentials(); valid {
+			switch {
+			case a.HttpRequest.Method != "GET" && a.Impersonated():
+				a.NewError(http.StatusForbidden, errImpersonation.Error())
+			case a.HttpRequest.Method == "POST":
+				a.Create()
+			case a.HttpRequest.Method == "DELETE":
+				a.Revoke()
+			default:
+				a.List()
+			}
+		} else if err == nil {
+			err = errors.New("Invalid credentials")
+		}
+	}
+
+	if err != nil {
+		a.NewError(http.StatusUnauthorized, err.Error())
+	}
+}
+
+// Create stores a new api key. The requested systems and rights have to be available to the user.
+func (a *ApiKeyHandler) Create() {
+	var req ApiKeyRequest
+
+	if err := DecodeJsonRequest(a.HttpRequest.Body, &req); err != nil {
+		a.NewError(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if req.Name == "" || len(req.Systems) == 0 {
+		a.NewError(http.StatusBadRequest, "An api key requires a name and at least one system")
+		return
+	}
+
+	if len(req.Rights) == 0 {
+		req.Rights = []string{"read"}
+	}
+
+	if req.Expires != "" {
+		if exp, err := time.Parse(time.RFC3339, req.Expires); err != nil || exp.Before(time.Now()) {
+			a.NewError(http.StatusBadRequest, "Expires has to be a RFC3339 timestamp in the future")
+			return
+		}
+	}
+
+	if err := a.grantable(req.Systems, req.Rights); err != nil {
+		a.NewError(http.StatusForbidden, err.Error())
+		return
+	}
+
+	secret := randomHex(20)
+	key := &ApiKey{
+		Id:          randomHex(20),
+		Name:        req.Name,
+		Owner:       a.Username,
+		OwnerID:     a.userID(),
+		Systems:     req.Systems,
+		Rights:      req.Rights,
+		Created:     time.Now().UTC().Format(time.RFC3339),
+		Expires:     req.Expires,
+		Quota:       req.Quota,
+		QuotaPeriod: req.QuotaPeriod,
+		Salt:        randomHex(32),
+	}
+	key.Hash = HashApiKeySecret(secret, key.Salt)
+
+	doc, err := json.Marshal(key)
+
+	if err == nil {
+		couch := NewCouch(a.Couchdb, a.Keydb)
+		_, err = couch.Post(doc)
+	}
+
+	if err != nil {
+		a.NewError(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Return the key once. It can't be recovered from the database later
+	key.Key = apiKeyPrefix + key.Id + "." + secret
+	key.Hash = ""
+	key.Salt = ""
+
+	a.Response.Status = http.StatusCreated
+	a.Response.Keys = key
+}
+
+// List responds with the api keys owned by the user
+func (a *ApiKeyHandler) List() {
+	keys, err := a.ownedKeys()
+
+	if err != nil {
+		a.NewError(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	a.Response.Status = http.StatusOK
+	a.Response.Keys = keys
+}
+
+// Revoke marks the api key in the last path segment as revoked
+func (a *ApiKeyHandler) Revoke() {
+	segs := strings.Split(strings.Trim(a.HttpRequest.URL.Path, "/"), "/")
+	id := segs[len(segs)-1]
+
+	couch := NewCouch(a.Couchdb, a.Keydb)
+	key, err := FetchApiKey(couch, id)
+
+	if err != nil || key.Owner != a.Username {
+		a.NewError(http.StatusNotFound, "Unknown api key")
+		return
+	}
+
+	key.Revoked = time.Now().UTC().Format(time.RFC3339)
+	doc, err := json.Marshal(key)
+
+	if err == nil {
+		_, err = couch.Post(doc)
+	}
+
+	if err != nil {
+		a.NewError(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	a.NewResponse(http.StatusOK, "Api key "+key.Name+" was revoked")
+}
+
+// grantable checks that every requested system and right is available to the user
+func (a *ApiKeyHandler) grantable(systems []string, rights []string) error {
+	accessList, err := a.AccessList()
+	if err != nil {
+		return err
+	}
+
+	for _, system := range systems {
+		entry, match := a.MatchEntry(system, accessList)
+		if !match {
+			return errors.New("You do not have access to " + system)
+		}
+
+		if PolicyGuarded(entry) {
+			return errors.New("Api keys can't be issued for " + system + " because access is restricted by a policy")
+		}
+
+		for _, right := range rights {
+			if !containsRight(entry["rights"], right) {
+				return errors.New("You do not have the " + right + " right on " + system)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (a *ApiKeyHandler) ownedKeys() ([]ApiKey, error) {
+	return OwnedApiKeys(a.Backend, a.Username)
+}
+
+// OwnedApiKeys retrieves the api keys of the owner without their hashes
+func OwnedApiKeys(backend *Backend, owner string) ([]ApiKey, error) {
+	var keys []ApiKey
+
+	couch := NewCouch(backend.Couchdb, backend.Keydb)
+	docs, err := couch.Find(map[string]interface{}{"owner": owner})
+
+	if err == nil {
+		var raw []byte
+		if raw, err = json.Marshal(docs); err == nil {
+			err = json.Unmarshal(raw, &keys)
+		}
+	}
+
+	for i := range keys {
+		keys[i].Hash = ""
+		keys[i].Salt = ""
+	}
+
+	return keys, err
+}
+
+// FetchApiKey loads an api key document from the key database
+func FetchApiKey(couch *CouchDB, id string) (*ApiKey, error) {
+	var key ApiKey
+
+	doc, err := couch.Get(id)
+
+	if err == nil {
+		var raw []byte
+		if raw, err = json.Marshal(doc); err == nil {
+			err = json.Unmarshal(raw, &key)
+		}
+	}
+
+	return &key, err
+}
+
+// HashApiKeySecret generates the salted hash stored for an api key secret
+func HashApiKeySecret(secret string, salt string) string {
+	creds := &Credentials{HashAlg: crypto.SHA512}
+	return creds.GenerateHash(secret + salt)
+}
+
+// IsApiKey checks if the key is a persistent api key
+func IsApiKey(key string) bool {
+	return strings.HasPrefix(key, apiKeyPrefix)
+}
+
+// ValidateApiKey checks a persistent api key and returns the key document and the user document
+// of the owner when it's valid. Authentic keys that are revoked or expired are returned along with the error.
+func ValidateApiKey(backend *Backend, key string) (*ApiKey, map[string]interface{}, error) {
+	segs := strings.Split(strings.TrimPrefix(key, apiKeyPrefix), ".")
+
+	if len(segs) != 2 || backend.Keydb == "" {
+		return nil, nil, errApiKeyInvalid
+	}
+
+	apiKey, err := FetchApiKey(NewCouch(backend.Couchdb, backend.Keydb), segs[0])
+
+	if err != nil {
+		return nil, nil, errApiKeyInvalid
+	}
+
+	if subtle.ConstantTimeCompare([]byte(apiKey.Hash), []byte(HashApiKeySecret(segs[1], apiKey.Salt))) != 1 {
+		return nil, nil, errApiKeyInvalid
+	}
+
+	// From here on the key is authentic so return it along with the error for auditing purposes
+	if apiKey.Revoked != "" {
+		return apiKey, nil, errApiKeyRevoked
+	}
+
+	if exp, ok := parseGrantTime(apiKey.Expires); ok && !time.Now().Before(exp) {
+		return apiKey, nil, errApiKeyExpired
+	}
+
+	// Keys die with the account they belong to
+	owner, err := apiKeyOwner(backend, apiKey)
+	if err != nil || owner["active"] != true {
+		return apiKey, nil, errApiKeyOwnerInactive
+	}
+
+	return apiKey, owner, nil
+}
+
+// apiKeyOwner loads the owner of the key by the stable user id. Keys created before owners
+// were recorded by id are resolved through the owner address.
+func apiKeyOwner(backend *Backend, apiKey *ApiKey) (map[string]interface{}, error) {
+	if apiKey.OwnerID == "" {
+		return FetchUserByEmail(backend, apiKey.Owner)
+	}
+
+	owner, err := FetchUserByID(backend, apiKey.OwnerID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Report and authorize the key under the current address of the owner
+	if email, ok := owner["email"].(string); ok && email != "" {
+		apiKey.Owner = email
+	}
+
+	return owner, nil
+}
+
+// ApiKeyAccessible checks that the owner still holds the rights of the key on the system. Keys
+// don't outlive the groups and systems they were issued from.
+func ApiKeyAccessible(backend *Backend, apiKey *ApiKey, owner map[string]interface{}, system string) bool {
+	auth := &Authorizer{Credentials: Credentials{Backend: backend, Username: apiKey.Owner, UserInfo: owner}}
+	auth.policyCtx = &PolicyContext{Time: time.Now().UTC(), User: owner}
+
+	entry, match := auth.MatchEntry(system, auth.userAccessList())
+	if !match || PolicyGuarded(entry) {
+		return false
+	}
+
+	for _, right := range apiKey.Rights {
+		if !containsRight(entry["rights"], right) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// containsRight checks if the rights list holds the right
+func containsRight(rights interface{}, right string) bool {
+	switch list := rights.(type) {
+	case []interface{}:
+		for _, r := range list {
+			if r == right {
+				return true
+			}
+		}
+	case []string:
+		for _, r := range list {
+			if r == right {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,177 @@
+package gouncer
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+const (
+	pendingStatus = "pending" // Status of accounts awaiting approval
+)
+
+// Approval lets admins and configured approvers handle accounts awaiting approval
+type Approval struct {
+	Authorizer
+	*Core
+	*MailConfig
+	Registrations map[string]Registration
+}
+
+func NewApproval(h *ResponseHandler) *Approval {
+	return &Approval{Authorizer: Authorizer{ResponseHandler: h}}
+}
+
+// HandleRequest validates the caller and lists (GET), approves (POST /approvals/<email>)
+// or rejects (DELETE /approvals/<email>) pending accounts
+func (a *Approval) HandleRequest() {
+	err := a.ParseAuthHeader(a.HttpRequest.Header.Get("Authorization"))
+
+	if err == nil {
+		var valid bool
+		if valid, err = a.ValidCredentials(); valid {
+			switch a.HttpRequest.Method {
+			case "POST":
+				a.Decide(true)
+			case "DELETE":
+				a.Decide(false)
+			default:
+				a.List()
+			}
+			return
+		} else if err == nil {
+			err = errors.New("Invalid credentials")
+		}
+	}
+
+	a.NewError(http.StatusUnauthorized, err.Error())
+}
+
+// List responds with the pending accounts the caller can approve
+func (a *Approval) List() {
+	couch := NewCouch(a.Couchdb, a.Userdb)
+	docs, err := couch.Find(map[string]interface{}{"status": pendingStatus})
+
+	if err != nil {
+		a.NewError(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	admin := a.IsAdmin(a.AdminSystem)
+	var pending []interface{}
+
+	for _, doc := range docs {
+		user := doc.(map[string]interface{})
+		email, _ := user["email"].(string)
+
+		if admin || a.approver(email) {
+			pending = append(pending, map[string]interface{}{"email": email, "name": user["name"], "groups": user["groups"]})
+		}
+	}
+
+	a.Response.Status = http.StatusOK
+	a.Response.Users = pending
+}
+
+// Decide approves or rejects the pending account in the last path segment and mails the outcome to the applicant
+func (a *Approval) Decide(approve bool) {
+	segs := strings.Split(strings.Trim(a.HttpRequest.URL.Path, "/"), "/")
+	email := strings.ToLower(segs[len(segs)-1])
+
+	// Check the caller first so the endpoint doesn't reveal which accounts are pending
+	if !a.IsAdmin(a.AdminSystem) && !a.approver(email) {
+		a.NewError(http.StatusForbidden, "You are not allowed to approve accounts for this domain")
+		return
+	}
+
+	couch := NewCouch(a.Couchdb, a.Userdb)
+	user, err := FetchUserByEmail(a.Backend, email)
+
+	if err != nil || user["status"] != pendingStatus {
+		a.NewError(http.StatusNotFound, "No pending account for: "+email)
+		return
+	}
+
+	if approve {
+		user["active"] = true
+		delete(user, "status")
+
+		var doc []byte
+		if doc, err = json.Marshal(user); err == nil {
+			_, err = couch.Post(doc)
+		}
+	} else {
+		_, err = couch.Delete(user["_id"].(string))
+	}
+
+	if approve {
+		a.audit("approve", email, err)
+	} else {
+		a.audit("reject", email, err)
+	}
+
+	if err != nil {
+		a.NewError(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	mail := NewMailClient(email, "")
+	mail.MailConfig = a.MailConfig
+	mail.Backend = a.Backend
+	mail.Core = a.Core
+
+	if err = mail.ApprovalOutcome(approve); err != nil {
+		a.Logger.Println("APPROVAL MAIL:", err)
+	}
+
+	if approve {
+		a.NewResponse(http.StatusOK, "The account for "+email+" was approved.")
+	} else {
+		a.NewResponse(http.StatusOK, "The account for "+email+" was rejected.")
+	}
+}
+
+// audit records the approval decision in the audit log with the caller as actor
+func (a *Approval) audit(action string, owner string, err error) {
+	event := NewAuditEvent("admin", a.HttpRequest)
+	event.Action = action
+	event.Owner = owner
+	a.MarkActor(event)
+	event.Success = err == nil
+
+	if err != nil {
+		event.Error = err.Error()
+	}
+
+	a.Audit(event)
+}
+
+// approver checks if the caller is a configured approver for the domain of the email address
+func (a *Approval) approver(email string) bool {
+	rule, _ := MatchRegistration(a.Registrations, email)
+
+	for _, approver := range rule.Approvers {
+		if strings.EqualFold(approver, a.Username) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// NotifyApprovers mails the approvers configured for the domain of the pending account
+func NotifyApprovers(backend *Backend, core *Core, mailConfig *MailConfig, registrations map[string]Registration, email string) {
+	rule, _ := MatchRegistration(registrations, email)
+
+	for _, approver := range rule.Approvers {
+		mail := NewMailClient(approver, "")
+		mail.MailConfig = mailConfig
+		mail.Backend = backend
+		mail.Core = core
+
+		if err := mail.ApprovalRequest(email); err != nil {
+			backend.Logger.Println("APPROVAL MAIL:", err)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package gouncer
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// AuditEvent is a single entry in the audit database
+type AuditEvent struct {
+	Type      string `json:"type"`                // Event type eg. key
+	Action    string `json:"action,omitempty"`    // Action taken eg. delete
+	Owner     string `json:"owner,omitempty"`     // User the event belongs to
+	Actor     string `json:"actor,omitempty"`     // User that performed the action when it's not the owner
+	ActingAs  string `json:"acting_as,omitempty"` // User impersonated by the actor
+	KeyID     string `json:"key_id,omitempty"`    // Key involved in the event
+	System    string `json:"system,omitempty"`    // System the request targeted
+	IP        string `json:"ip,omitempty"`        // Client ip address
+	UserAgent string `json:"user_agent,omitempty"`
+	Timestamp string `json:"timestamp"`
+	Success   bool   `json:"success"`
+	Error     string `json:"error,omitempty"`
+}
+
+// NewAuditEvent creates an event of the type with the client info of the request
+func NewAuditEvent(eventType string, r *http.Request) *AuditEvent {
+	event := &AuditEvent{
+		Type:      eventType,
+		UserAgent: r.Header.Get("User-Agent"),
+		Timestamp: time.Now().UTC().Format(time.RFC3339Nano),
+	}
+
+	if ip := ClientIP(r); ip != nil {
+		event.IP = ip.String()
+	}
+
+	return event
+}
+
+// MarkActor records the caller as actor when it acts on another account. Requests made with an
+// impersonation token are attributed to the impersonating admin.
+func (creds *Credentials) MarkActor(event *AuditEvent) {
+	if creds.Actor != "" {
+		event.Actor = creds.Actor
+		event.ActingAs = creds.Username
+	} else if creds.Username != event.Owner {
+		event.Actor = creds.Username
+	}
+}
+
+// Audit stores the event in the audit database. Writes happen in the background so auditing
+// never slows down the request. Without an audit database events are only logged.
+func (backend *Backend) Audit(event *AuditEvent) {
+	doc, err := json.Marshal(event)
+
+	if err != nil {
+		backend.Logger.Println("AUDIT:", err)
+		return
+	}
+
+	if backend.Auditdb == "" {
+		backend.Logger.Println("[AUDIT]", string(doc))
+		return
+	}
+
+	go func() {
+		couch := NewCouch(backend.Couchdb, backend.Auditdb)
+		if _, err := couch.Post(doc); err != nil {
+			backend.Logger.Println("AUDIT:", err)
+		}
+	}()
+}
+
+// AuditEvents retrieves the events matching the selector, newest first
+func (backend *Backend) AuditEvents(selector map[string]interface{}) ([]AuditEvent, error) {
+	var events []AuditEvent
+
+	couch := NewCouch(backend.Couchdb, backend.Auditdb)
+	docs, err := couch.Find(selector)
+
+	if err == nil {
+		var raw []byte
+		if raw, err = json.Marshal(docs); err == nil {
+			err = json.Unmarshal(raw, &events)
+		}
+	}
+
+	sort.Slice(events, func(i, j int) bool { return events[i].Timestamp > events[j].Timestamp })
+
+	return events, err
+}
+
+// ClientIP returns the ip address of the client that sent the request
+func ClientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	return net.ParseIP(host)
+}
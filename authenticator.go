@@ -2,7 +2,9 @@ package gouncer
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
 	"time"
 
@@ -13,6 +15,7 @@ type Authenticator struct {
 	Credentials
 	*Token
 	*ResponseHandler
+	Scopes []*Scope // Scopes limiting the systems in the token. Applied in order.
 }
 
 func NewAuthenticator(h *ResponseHandler) *Authenticator {
@@ -34,12 +37,64 @@ func (auth *Authenticator) HandleTokenRequest() {
 // checks out it calls the TokenResponse to generate the actual response
 func (auth *Authenticator) ProcessTokenRequest() {
 	if valid, err := auth.ValidCredentials(); valid {
-		auth.TokenResponse(auth.UserInfo)
+		if auth.Impersonated() {
+			// Refreshing would outlive the impersonation lifetime. Admins have to request a new token.
+			auth.NewError(http.StatusForbidden, "Impersonation tokens can't be revalidated")
+		} else if err = auth.resolveScopes(); err == nil {
+			auth.TokenResponse(auth.UserInfo)
+		} else {
+			auth.NewError(http.StatusBadRequest, err.Error())
+		}
 	} else {
 		auth.NewError(http.StatusUnauthorized, err.Error())
 	}
 }
 
+// resolveScopes collects the scopes of the token being revalidated (so a refresh can never widen
+// a scoped token) and adds the scope requested through the query parameters
+func (auth *Authenticator) resolveScopes() error {
+	if auth.Jwt != nil && auth.Credentials.Token != "" {
+		scopes, err := ClaimScopes(auth.Jwt.Claim.Content["scope"])
+		if err != nil {
+			return err
+		}
+
+		auth.Scopes = scopes
+	}
+
+	if scope := ParseScope(auth.HttpRequest.URL.Query()); scope != nil {
+		auth.Scopes = append(auth.Scopes, scope)
+	}
+
+	return nil
+}
+
+// HandleSystemsRequest responds with the systems of the bearer token in the request
+func (auth *Authenticator) HandleSystemsRequest() {
+	err := auth.ParseAuthHeader(auth.HttpRequest.Header.Get("Authorization"))
+
+	if err == nil && auth.Credentials.Token == "" {
+		err = errors.New("This endpoint requires a bearer token")
+	}
+
+	if err == nil {
+		var valid bool
+		if valid, err = auth.ValidToken(); valid {
+			var systems []interface{}
+			if systems, err = auth.TokenSystems(); err == nil {
+				auth.Response.Status = http.StatusOK
+				auth.Response.Systems = systems
+			}
+		} else if err == nil {
+			err = errors.New("Invalid token")
+		}
+	}
+
+	if err != nil {
+		auth.NewError(http.StatusUnauthorized, err.Error())
+	}
+}
+
 // TokenResponse uses the toki JWT generator library to create a new JWT.
 // The resulting JWT is then set as the resonse token
 func (auth *Authenticator) TokenResponse(userInfo map[string]interface{}) {
@@ -87,8 +142,13 @@ func (auth *Authenticator) ResolveAlgorithm() *toki.Algorithm {
 func (auth *Authenticator) CacheTokenInfo() error {
 	data, err := json.Marshal(&CacheObj{auth.Secret})
 
+	// Impersonation sessions have to be known to RevokeSessions
+	if err == nil && auth.Actor != "" {
+		err = auth.TrackActor(auth.Expiration)
+	}
+
 	if err == nil {
-		return auth.CacheCredentials(auth.Username, data, auth.Expiration)
+		return auth.CacheCredentials(SecretCache, auth.sessionKey(), data, auth.Expiration)
 	}
 
 	return err
@@ -98,10 +158,20 @@ func (auth *Authenticator) CacheTokenInfo() error {
 func (auth *Authenticator) TokenBody(userData map[string]interface{}) map[string]interface{} {
 	var content = make(map[string]interface{})
 	var systems []interface{}
-	var kList = &KeyList{ID: auth.Credentials.GenerateUserKey(), Pairs: make(map[string]string)}
+	var kList = NewKeyList(auth.sessionKeyListID())
+	kList.Owner = auth.Username
+	kList.Actor = auth.Actor
 
 	content["email"] = auth.Username
 
+	if auth.Actor != "" {
+		content["act"] = map[string]interface{}{"email": auth.Actor}
+	}
+
+	if id, exists := userData["_id"].(string); exists && !legacyUser(userData) {
+		content["sub"] = id
+	}
+
 	if name, exists := userData["name"]; exists {
 		content["name"] = name
 	}
@@ -114,48 +184,98 @@ func (auth *Authenticator) TokenBody(userData map[string]interface{}) map[string
 		systems = auth.ResolveGroupsToSystems(groups.([]interface{}))
 
 		for _, s := range systems {
-			key := auth.CharSalt(32)
-			kList.Pairs[key] = s.(map[string]interface{})["uri"].(string)
-			s.(map[string]interface{})["key"] = fmt.Sprintf("%s+%s", kList.ID, key)
+			auth.addReadKey(kList, s)
 		}
 	}
 
 	if list, exists := userData["systems"].([]interface{}); exists {
-		systems = auth.ResolveDuplicateSystems(list, systems, kList)
+		systems = auth.ResolveDuplicateSystems(auth.ActiveSystems(list), systems, kList)
 	}
 
+	// Narrow the systems down to the requested scopes and only hand out keys for what is left
+	if len(auth.Scopes) > 0 {
+		for _, scope := range auth.Scopes {
+			systems = scope.Apply(systems)
+		}
+
+		kList = NewKeyList(kList.ID)
+		kList.Owner = auth.Username
+		kList.Actor = auth.Actor
+		for _, s := range systems {
+			auth.addReadKey(kList, s)
+		}
+
+		content["scope"] = auth.Scopes
+	}
+
+	now := time.Now()
+	exp := now.Add(time.Duration(auth.Expiration) * time.Second)
+
+	// Don't let the token outlive the memberships and grants it was built from
+	if expiry, expires := auth.GrantsExpiry(userData, systems); expires && expiry.Before(exp) {
+		exp = expiry
+	}
+
+	// The read keys and the systems reference live exactly as long as the token
+	lifetime := cacheLifetime(now, exp)
+
 	if len(systems) > 0 {
-		content["systems"] = systems
+		auth.setSystemsClaim(content, systems, lifetime)
 	}
 
-	content["exp"] = time.Now().Add(time.Duration(auth.Expiration) * time.Second).Unix() // Move expiration control to the token
-	auth.CacheKeyList(kList, auth.Expiration)                                            // Save The KeyList
+	content["exp"] = exp.Unix()        // Move expiration control to the token
+	auth.CacheKeyList(kList, lifetime) // Save The KeyList
 
 	return content
 }
 
+// cacheLifetime converts the token expiry into a cache expiration in seconds. It never returns
+// 0 because memcache treats that as an entry that doesn't expire.
+func cacheLifetime(now time.Time, exp time.Time) int32 {
+	lifetime := int32(math.Ceil(exp.Sub(now).Seconds()))
+
+	if lifetime < 1 {
+		return 1
+	}
+
+	return lifetime
+}
+
+// setSystemsClaim embeds the systems in the token. When the list is larger than the configured
+// compact limit it is stored server side and the token only carries a reference and a hash.
+func (auth *Authenticator) setSystemsClaim(content map[string]interface{}, systems []interface{}, lifetime int32) {
+	if auth.CompactSystems > 0 && len(systems) > auth.CompactSystems {
+		ref, hash, err := auth.StoreSystems(systems, lifetime)
+
+		if err == nil {
+			content["systems_ref"] = ref
+			content["systems_hash"] = hash
+			return
+		}
+
+		auth.Logger.Println("SYSTEMS CACHE:", err)
+	}
+
+	content["systems"] = systems
+}
+
 func (auth *Authenticator) ResolveDuplicateSystems(userSystems []interface{}, systems []interface{}, kl *KeyList) []interface{} {
-	for l, uSys := range userSystems {
+	for _, uSys := range userSystems {
 		accessible := true
 
 		// Check if the system already exists and override if found
 		for i, system := range systems {
 			if system.(map[string]interface{})["uri"] == uSys.(map[string]interface{})["uri"] {
-				key := auth.CharSalt(32)
-				kl.Pairs[key] = uSys.(map[string]interface{})["uri"].(string)
-				uSys.(map[string]interface{})["key"] = fmt.Sprintf("%s+%s", kl.ID, key)
+				auth.addReadKey(kl, uSys)
 
 				systems[i] = uSys
-				userSystems = append(userSystems[:l], userSystems[l+1:]...) // When overriding remove the item from the list
 				accessible = false
 			}
 		}
 
 		// If non existent append the system into the list
 		if accessible {
-			key := auth.CharSalt(32)
-			kl.Pairs[key] = uSys.(map[string]interface{})["uri"].(string)
-			uSys.(map[string]interface{})["key"] = fmt.Sprintf("%s+%s", kl.ID, key)
+			auth.addReadKey(kl, uSys)
 
 			systems = append(systems, uSys)
 		}
@@ -163,3 +283,33 @@ func (auth *Authenticator) ResolveDuplicateSystems(userSystems []interface{}, sy
 
 	return systems
 }
+
+// addReadKey generates a read key for the system and records the uri and rights in the key list.
+// Systems guarded by a policy don't get a read key.
+// The rights come from the optional key_rights list of the system entry, limited to the rights of
+// the entry itself, and default to read.
+func (auth *Authenticator) addReadKey(kl *KeyList, system interface{}) {
+	sys := system.(map[string]interface{})
+
+	// Keys are validated without the client request so policies can't be enforced on them
+	if PolicyGuarded(sys) {
+		delete(sys, "key")
+		return
+	}
+
+	key := auth.CharSalt(32)
+	rights := []string{"read"}
+
+	if keyRights, exists := sys["key_rights"].([]interface{}); exists {
+		rights = nil
+		for _, right := range keyRights {
+			if r, ok := right.(string); ok && containsRight(sys["rights"], r) {
+				rights = append(rights, r)
+			}
+		}
+	}
+
+	kl.Pairs[key] = sys["uri"].(string)
+	kl.Rights[key] = rights
+	sys["key"] = fmt.Sprintf("%s%s%s", kl.ID, keySeparator, key)
+}
@@ -1,15 +1,60 @@
 package gouncer
 
 import (
+	"encoding/json"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 )
 
 type Authorizer struct {
 	Credentials
 	Expiration int32 // Token expriation time. Used on touch.
+	Debug      bool  // Allow explain traces on authorization requests
 	*ResponseHandler
+	ExplainSystem string // Explain traces require the admin right on this system
+	policyCtx     *PolicyContext
+	userAccess    *resolvedAccess
+}
+
+// resolvedAccess caches the access list of a basic auth user for the duration of the request
+type resolvedAccess struct {
+	list       []interface{}
+	considered []TraceEntry
+}
+
+// BatchRequest holds the list of systems submitted to the batch endpoint
+type BatchRequest struct {
+	Systems []BatchSystem `json:"systems"`
+}
+
+// BatchSystem is a single system in a batch request. It can be submitted as
+// a plain uri string or as an object with an optional http method.
+type BatchSystem struct {
+	System string `json:"system"`
+	Method string `json:"method,omitempty"`
+}
+
+// BatchResult holds the authorization outcome for a single system in a batch request
+type BatchResult struct {
+	System string      `json:"system" xml:"uri,attr"`
+	Method string      `json:"method,omitempty" xml:"method,attr,omitempty"`
+	Access bool        `json:"access" xml:"access,attr"`
+	Rights interface{} `json:"rights,omitempty" xml:"Right,omitempty"`
+	Error  string      `json:"error,omitempty" xml:"error,attr,omitempty"`
+}
+
+// UnmarshalJSON accepts both "uri" and {"system": "uri", "method": "GET"} entries
+func (b *BatchSystem) UnmarshalJSON(data []byte) error {
+	var uri string
+	if err := json.Unmarshal(data, &uri); err == nil {
+		b.System = uri
+		return nil
+	}
+
+	type batchSystem BatchSystem
+	return json.Unmarshal(data, (*batchSystem)(b))
 }
 
 // NewAuthorizer configures the Authorizer and returns a pointer
@@ -37,11 +82,29 @@ func (auth *Authorizer) AuthorizeRequest() {
 // ValidateRequest checks if the caller has any access rights on the system
 func (auth *Authorizer) ValidateRequest(req map[string]interface{}) {
 	if system, exists := req["system"].(string); exists {
+		explain, _ := req["explain"].(bool)
+
+		if explain && !auth.Debug {
+			auth.NewError(http.StatusBadRequest, "Explain mode is not enabled on this server")
+			return
+		}
+
 		if auth.Token == "" && auth.Password != "" {
 			auth.AuthorizedUser(system)
 		} else {
 			auth.AuthorizedToken(system)
 		}
+
+		// Only explain decisions to admins with valid credentials
+		if explain && auth.Response.Status != http.StatusUnauthorized {
+			if !auth.IsAdmin(auth.ExplainSystem) {
+				auth.NewError(http.StatusForbidden, "Explain mode requires the admin right on the admin system")
+			} else if auth.Token == "" && auth.Password != "" {
+				auth.Response.Explain = auth.ExplainUser(system)
+			} else {
+				auth.Response.Explain = auth.ExplainToken(system)
+			}
+		}
 	} else {
 		auth.NewError(http.StatusBadRequest, "No system info provided")
 	}
@@ -50,46 +113,179 @@ func (auth *Authorizer) ValidateRequest(req map[string]interface{}) {
 // AutorizedUser checks if the user has any access rights for the system
 func (auth *Authorizer) AuthorizedUser(system string) {
 	if valid, err := auth.ValidBasicAuth(); valid {
-		var accessList []interface{}
+		auth.SystemAccessible(system, auth.userAccessList())
+	} else {
+		auth.NewError(http.StatusUnauthorized, err.Error())
+	}
+}
 
-		if groups, exists := auth.UserInfo["groups"].([]interface{}); exists {
-			accessList = auth.ResolveGroupsToSystems(groups)
+// AuthorizedToken checks if the token has access rights for the system
+func (auth *Authorizer) AuthorizedToken(system string) {
+	if valid, err := auth.ValidToken(); valid {
+		if accessList, err := auth.TokenSystems(); err == nil {
+			auth.SystemAccessible(system, accessList)
+		} else {
+			auth.NewError(http.StatusUnauthorized, err.Error())
 		}
+	} else {
+		auth.NewError(http.StatusUnauthorized, err.Error())
+	}
+}
+
+// AuthorizeBatch handles authorization checking for a list of systems with a single credential check
+func (auth *Authorizer) AuthorizeBatch() {
+	err := auth.ParseAuthHeader(auth.HttpRequest.Header.Get("Authorization"))
+
+	if err == nil {
+		var req BatchRequest
 
-		if list, exists := auth.UserInfo["systems"].([]interface{}); exists {
-			accessList = auth.ResolveDuplicateSystems(list, accessList)
+		if err = DecodeJsonRequest(auth.HttpRequest.Body, &req); err == nil {
+			auth.ValidateBatch(req)
 		}
+	}
 
-		auth.SystemAccessible(system, accessList)
-	} else {
+	if err != nil {
 		auth.NewError(http.StatusUnauthorized, err.Error())
 	}
 }
 
-// AuthorizedToken checks if the token has access rights for the system
-func (auth *Authorizer) AuthorizedToken(system string) {
-	if valid, err := auth.ValidToken(); valid {
-		var accessList []interface{}
+// ValidateBatch validates the credentials once and resolves the rights for every system in the request
+func (auth *Authorizer) ValidateBatch(req BatchRequest) {
+	if len(req.Systems) == 0 {
+		auth.NewError(http.StatusBadRequest, "No system info provided")
+		return
+	}
 
-		if sys, exists := auth.Jwt.Claim.Content["systems"]; exists {
-			accessList = sys.([]interface{})
+	var accessList []interface{}
+
+	if auth.Token == "" && auth.Password != "" {
+		valid, err := auth.ValidBasicAuth()
+		if !valid {
+			auth.NewError(http.StatusUnauthorized, err.Error())
+			return
 		}
 
-		auth.SystemAccessible(system, accessList)
+		accessList = auth.userAccessList()
 	} else {
-		auth.NewError(http.StatusUnauthorized, err.Error())
+		valid, err := auth.ValidToken()
+		if !valid {
+			auth.NewError(http.StatusUnauthorized, err.Error())
+			return
+		}
+
+		if accessList, err = auth.TokenSystems(); err != nil {
+			auth.NewError(http.StatusUnauthorized, err.Error())
+			return
+		}
+	}
+
+	results := make([]BatchResult, 0, len(req.Systems))
+
+	for _, sys := range req.Systems {
+		result := BatchResult{System: sys.System, Method: strings.ToUpper(sys.Method)}
+
+		if _, err := url.Parse(sys.System); err != nil {
+			result.Error = "Invalid system uri"
+			results = append(results, result)
+			continue
+		}
+
+		if rights, match := auth.MatchSystem(sys.System, accessList); match {
+			result.Rights = rights
+			result.Access = result.Method == "" || auth.MethodAllowed(result.Method, rights)
+		}
+
+		results = append(results, result)
 	}
+
+	auth.Response.Status = http.StatusOK
+	auth.Response.Systems = results
 }
 
+// AccessList returns the systems available to the validated caller
+func (auth *Authorizer) AccessList() ([]interface{}, error) {
+	if auth.Credentials.Token == "" && auth.Password != "" {
+		return auth.userAccessList(), nil
+	}
+
+	return auth.TokenSystems()
+}
+
+// IsAdmin checks if the validated caller holds the admin right on the admin system
+func (auth *Authorizer) IsAdmin(adminSystem string) bool {
+	if adminSystem == "" {
+		return false
+	}
+
+	accessList, err := auth.AccessList()
+
+	if err == nil {
+		if rights, match := auth.MatchSystem(adminSystem, accessList); match {
+			return containsRight(rights, "admin")
+		}
+	}
+
+	return false
+}
+
+// userAccessList resolves the groups and systems of a basic auth user into a single access list
+func (auth *Authorizer) userAccessList() []interface{} {
+	accessList, _ := auth.resolveUserAccess()
+	return accessList
+}
+
+// resolveUserAccess resolves the access list of a basic auth user along with a trace entry for
+// every group and user entry that was considered. The result is kept for the rest of the request.
+func (auth *Authorizer) resolveUserAccess() ([]interface{}, []TraceEntry) {
+	if auth.userAccess != nil {
+		return auth.userAccess.list, auth.userAccess.considered
+	}
+
+	var accessList []interface{}
+	var considered []TraceEntry
+
+	if groups, exists := auth.UserInfo["groups"].([]interface{}); exists {
+		var sources []string
+		accessList, sources = auth.groupSystems(groups)
+
+		for i, s := range accessList {
+			considered = append(considered, newTraceEntry(sources[i], s))
+		}
+	}
+
+	if list, exists := auth.UserInfo["systems"].([]interface{}); exists {
+		userSystems := auth.ActiveSystems(list)
+
+		// Mirror the overrides of ResolveDuplicateSystems in the trace
+		for _, s := range userSystems {
+			entry := newTraceEntry("user", s)
+
+			for i := range considered {
+				if considered[i].Uri == entry.Uri {
+					considered[i].Overridden = true
+				}
+			}
+
+			considered = append(considered, entry)
+		}
+
+		accessList = auth.ResolveDuplicateSystems(userSystems, accessList)
+	}
+
+	auth.userAccess = &resolvedAccess{list: accessList, considered: considered}
+	return accessList, considered
+}
+
+// ResolveDuplicateSystems adds the user systems to the systems list. User systems replace
+// the entries with the same uri.
 func (auth *Authorizer) ResolveDuplicateSystems(userSystems []interface{}, systems []interface{}) []interface{} {
-	for l, uSys := range userSystems {
+	for _, uSys := range userSystems {
 		accessible := true
 
 		// Check if the system already exists and override if found
 		for i, system := range systems {
 			if system.(map[string]interface{})["uri"] == uSys.(map[string]interface{})["uri"] {
 				systems[i] = uSys
-				userSystems = append(userSystems[:l], userSystems[l+1:]...) // When overriding remove the item from the list
 				accessible = false
 			}
 		}
@@ -106,25 +302,118 @@ func (auth *Authorizer) ResolveDuplicateSystems(userSystems []interface{}, syste
 // SystemAccessible will check the users system list against the system we are authorizing.
 // If a match is found (exact|wildacrd) we will set the AccessRights in the auth.Response
 func (auth *Authorizer) SystemAccessible(system string, accessList []interface{}) {
-	match := false
-	var r interface{}
+	if r, match := auth.MatchSystem(system, accessList); match {
+		auth.Response.Status = http.StatusOK
+		auth.Response.AccessRights = r
+	} else {
+		auth.NewError(http.StatusForbidden, "You do not have access to this system")
+	}
+}
+
+// MatchSystem returns the rights of the last access list entry matching the system (exact|wildcard)
+func (auth *Authorizer) MatchSystem(system string, accessList []interface{}) (interface{}, bool) {
+	if entry, match := auth.MatchEntry(system, accessList); match {
+		return entry["rights"], true
+	}
+
+	return nil, false
+}
+
+// MatchEntry returns the last access list entry matching the system (exact|wildcard) whose policy allows the request
+func (auth *Authorizer) MatchEntry(system string, accessList []interface{}) (map[string]interface{}, bool) {
+	var entry map[string]interface{}
+
+	reqUrl, err := url.Parse(system)
+	if err != nil {
+		return nil, false
+	}
+
 	for _, accessItem := range accessList {
-		sysUrl, _ := url.Parse(accessItem.(map[string]interface{})["uri"].(string))
-		reqUrl, _ := url.Parse(system)
+		item, ok := accessItem.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		// Skip entries with a broken uri instead of matching against them
+		uri, _ := item["uri"].(string)
+		sysUrl, err := url.Parse(uri)
+		if uri == "" || err != nil {
+			continue
+		}
+
 		if sysUrl.Host == reqUrl.Host {
 			if auth.ExactPathMatch(sysUrl.Path, reqUrl.Path) || auth.WildcardPathMatch(sysUrl.Path, reqUrl.Path) {
-				match = true
-				r = accessItem.(map[string]interface{})["rights"]
+				if allowed, _ := auth.PolicyAllows(item); allowed {
+					entry = item
+				}
 			}
 		}
 	}
 
-	if match {
-		auth.Response.Status = http.StatusOK
-		auth.Response.AccessRights = r
-	} else {
-		auth.NewError(http.StatusForbidden, "You do not have access to this system")
+	return entry, entry != nil
+}
+
+// PolicyGuarded checks if the access list entry carries a policy. Policies need the context of
+// the client request, so keys and signed urls validated without it are not issued for these entries.
+func PolicyGuarded(entry map[string]interface{}) bool {
+	policy, _ := entry["policy"].(string)
+	return policy != ""
+}
+
+// PolicyAllows evaluates the optional policy expression of an access list entry.
+// Entries without a policy are always allowed. Broken policies deny access.
+func (auth *Authorizer) PolicyAllows(accessItem interface{}) (bool, error) {
+	policy, _ := accessItem.(map[string]interface{})["policy"].(string)
+
+	if policy == "" {
+		return true, nil
 	}
+
+	allowed, err := EvaluatePolicy(policy, auth.PolicyContext())
+
+	if err != nil {
+		auth.Logger.Println("[POLICY]", accessItem.(map[string]interface{})["uri"], err)
+		return false, err
+	}
+
+	return allowed, nil
+}
+
+// PolicyContext builds the attributes policies are evaluated against from the current request
+func (auth *Authorizer) PolicyContext() *PolicyContext {
+	if auth.policyCtx == nil {
+		auth.policyCtx = &PolicyContext{Time: time.Now().UTC(), IP: ClientIP(auth.HttpRequest), User: auth.UserInfo}
+	}
+
+	return auth.policyCtx
+}
+
+// MethodAllowed checks if the rights contain the right required by the http method
+func (auth *Authorizer) MethodAllowed(method string, rights interface{}) bool {
+	var required string
+
+	switch method {
+	case "GET", "HEAD", "OPTIONS":
+		required = "read"
+	case "POST":
+		required = "create"
+	case "PUT", "PATCH":
+		required = "update"
+	case "DELETE":
+		required = "delete"
+	default:
+		return false
+	}
+
+	if list, ok := rights.([]interface{}); ok {
+		for _, right := range list {
+			if right == required {
+				return true
+			}
+		}
+	}
+
+	return false
 }
 
 // ExactPathMatch checks if the two paths are the same
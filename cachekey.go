@@ -0,0 +1,94 @@
+package gouncer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// CacheNamespace separates the cache entries of the different flows
+type CacheNamespace string
+
+const (
+	SecretCache       CacheNamespace = "secret"   // Token secrets per user
+	KeyListCache      CacheNamespace = "keylist"  // Read key lists
+	SystemsCache      CacheNamespace = "systems"  // Systems lists of compact tokens
+	RegistrationCache CacheNamespace = "register" // Registration confirmation codes
+	PendingCache      CacheNamespace = "pending"  // Pending registrations per address
+	CancelCache       CacheNamespace = "cancel"   // Account cancellation codes
+	OneTimeCache      CacheNamespace = "onetime"  // One time passwords
+	ResetCache        CacheNamespace = "reset"    // Password reset codes
+	EmailCache        CacheNamespace = "email"    // Email change codes
+	QuotaCache        CacheNamespace = "quota"    // Key quota counters
+	ActorCache        CacheNamespace = "actors"   // Admins with an impersonation session per user
+)
+
+const (
+	maxCacheKeyLength    = 250 // Memcache key length limit
+	maxCachePrefixLength = 128 // Leaves room for the namespace and the hashed key
+)
+
+// CacheKey builds the memcache key for the key in the namespace. The optional cache prefix
+// separates gouncer instances sharing a memcache cluster. Keys that are too long or contain
+// characters memcache doesn't accept are hashed.
+func (b *Backend) CacheKey(ns CacheNamespace, key string) string {
+	full := b.CachePrefix + string(ns) + ":" + key
+
+	if len(full) > maxCacheKeyLength || !validCacheKey(key) {
+		sum := sha256.Sum256([]byte(key))
+		full = b.CachePrefix + string(ns) + ":#" + hex.EncodeToString(sum[:])
+	}
+
+	return full
+}
+
+// ValidateCachePrefix checks that the prefix only holds letters, digits and -_.: and is short
+// enough for the prefixed keys to stay within the memcache key length limit once hashed.
+func ValidateCachePrefix(prefix string) error {
+	if len(prefix) > maxCachePrefixLength {
+		return fmt.Errorf("Cache prefix exceeds %d characters", maxCachePrefixLength)
+	}
+
+	for _, c := range prefix {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.:", c)) {
+			return errors.New("Cache prefix may only contain letters, digits and -_.:")
+		}
+	}
+
+	return nil
+}
+
+// CacheGet retrieves the entry for the key in the namespace
+func (b *Backend) CacheGet(ns CacheNamespace, key string) (*memcache.Item, error) {
+	return b.Cache.Get(b.CacheKey(ns, key))
+}
+
+// CacheSet stores the entry for the key in the namespace
+func (b *Backend) CacheSet(ns CacheNamespace, key string, value []byte, exp int32) error {
+	return b.Cache.Set(&memcache.Item{Key: b.CacheKey(ns, key), Value: value, Expiration: exp})
+}
+
+// CacheDelete removes the entry for the key in the namespace
+func (b *Backend) CacheDelete(ns CacheNamespace, key string) error {
+	return b.Cache.Delete(b.CacheKey(ns, key))
+}
+
+// validCacheKey checks for the whitespace and control characters memcache rejects. Keys starting
+// with the hash marker are hashed as well so they can't collide with hashed keys.
+func validCacheKey(key string) bool {
+	if strings.HasPrefix(key, "#") {
+		return false
+	}
+
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+
+	return true
+}
@@ -1,12 +1,25 @@
 package gouncer
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"net/http"
 	"strings"
+	"time"
+)
+
+const (
+	cancelledStatus      = "cancelled"       // Status of accounts awaiting deletion
+	defaultGracePeriod   = 30 * 24 * 60 * 60 // Seconds a cancelled account can be restored
+	defaultPurgeInterval = 60 * 60           // Seconds between purges of expired accounts
 )
 
 type Cancel struct {
 	*Backend
+	*Core
+	*MailConfig
+	*RegistrationConfig
 	Handler *ResponseHandler
 }
 
@@ -14,21 +27,56 @@ func NewCancellation(h *ResponseHandler) *Cancel {
 	return &Cancel{Handler: h}
 }
 
-// Registration completes the registration process after the user clicks the confirmation link
+// Confirm deactivates the account after the user clicks the cancellation link. The account is
+// deleted once the grace period expires and can be restored with the mailed code until then.
+// An optional link query parameter points the mailed restore link at a whitelisted page.
 func (c *Cancel) Confirm() {
 	segs := strings.Split(c.Handler.HttpRequest.URL.Path, "/")
 
-	if item, err := c.Backend.Cache.Get(segs[len(segs)-1]); err == nil {
+	link := c.Handler.HttpRequest.URL.Query().Get("link")
+	if link != "" && !c.allowedLink(link) {
+		c.Handler.NewError(http.StatusBadRequest, "Restore link does not appear on the whitelist")
+		return
+	}
+
+	if item, err := c.Backend.CacheGet(CancelCache, segs[len(segs)-1]); err == nil {
 		key := string(item.Value)
 
 		couch := NewCouch(c.Backend.Couchdb, c.Backend.Userdb)
-		if _, err := couch.Delete(key); err == nil {
-			// If the user object is correctly delete we wipe the cache entry for the cancellation request and any token still in the cache
-			c.Backend.Cache.Delete(segs[len(segs)-1])
-			c.Backend.Cache.Delete(key)
+		user, err := FetchUserByEmail(c.Backend, key)
+
+		restore := restoreCode()
+		deletion := time.Now().Add(time.Duration(c.gracePeriod()) * time.Second).UTC()
+
+		if err == nil {
+			user["active"] = false
+			user["status"] = cancelledStatus
+			user["deletion_date"] = deletion.Format(time.RFC3339)
+			user["restore_code"] = hashRestoreCode(restore)
+
+			var doc []byte
+			if doc, err = json.Marshal(user); err == nil {
+				_, err = couch.Post(doc)
+			}
+		}
+
+		if err == nil {
+			// If the user object is correctly updated we wipe the cache entry for the cancellation request and any session still in the cache
+			creds := &Credentials{Backend: c.Backend, Username: key}
+			c.Backend.CacheDelete(CancelCache, segs[len(segs)-1])
+			creds.RevokeSessions()
+
+			mail := NewMailClient(key, restore)
+			mail.MailConfig = c.MailConfig
+			mail.Backend = c.Backend
+			mail.Core = c.Core
+
+			if merr := mail.Restore(deletion, link); merr != nil {
+				c.Backend.Logger.Println("CANCELLATION:", merr)
+			}
 
 			// Respond to the user
-			c.Handler.NewResponse(http.StatusOK, "Cancellation successfull.")
+			c.Handler.NewResponse(http.StatusOK, "Cancellation successfull. Your account will be deleted on "+deletion.Format("2006-01-02")+". Use the code we sent you to restore it before then.")
 		} else {
 			c.Handler.NewError(http.StatusInternalServerError, err.Error())
 		}
@@ -37,3 +85,119 @@ func (c *Cancel) Confirm() {
 		c.Handler.NewError(http.StatusInternalServerError, err.Error())
 	}
 }
+
+// Restore reactivates the cancelled account the restore code in the last path segment belongs to
+func (c *Cancel) Restore() {
+	segs := strings.Split(strings.Trim(c.Handler.HttpRequest.URL.Path, "/"), "/")
+	code := segs[len(segs)-1]
+
+	couch := NewCouch(c.Backend.Couchdb, c.Backend.Userdb)
+	docs, err := couch.Find(map[string]interface{}{"status": cancelledStatus, "restore_code": hashRestoreCode(code)})
+
+	if err != nil || len(docs) == 0 || code == "" {
+		c.Handler.NewError(http.StatusNotFound, "Invalid or expired restore code")
+		return
+	}
+
+	user := docs[0].(map[string]interface{})
+
+	if date, ok := parseGrantTime(user["deletion_date"]); ok && !time.Now().Before(date) {
+		c.Handler.NewError(http.StatusGone, "The grace period for this account has expired")
+		return
+	}
+
+	user["active"] = true
+	delete(user, "status")
+	delete(user, "deletion_date")
+	delete(user, "restore_code")
+
+	doc, err := json.Marshal(user)
+
+	if err == nil {
+		_, err = couch.Post(doc)
+	}
+
+	if err != nil {
+		c.Handler.NewError(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.Handler.NewResponse(http.StatusOK, "Your account was restored. You can login again.")
+}
+
+func (c *Cancel) gracePeriod() int32 {
+	if c.RegistrationConfig != nil && c.GracePeriod > 0 {
+		return c.GracePeriod
+	}
+
+	return defaultGracePeriod
+}
+
+// PurgeCancelledAccounts deletes the cancelled accounts whose grace period expired together with
+// their sessions and api keys. It returns the number of deleted accounts.
+func PurgeCancelledAccounts(backend *Backend) (int, error) {
+	couch := NewCouch(backend.Couchdb, backend.Userdb)
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	docs, err := couch.Find(map[string]interface{}{"status": cancelledStatus, "deletion_date": map[string]interface{}{"$lte": now}})
+
+	if err != nil {
+		return 0, err
+	}
+
+	var purged int
+
+	for _, d := range docs {
+		user := d.(map[string]interface{})
+		id, _ := user["_id"].(string)
+		email, _ := user["email"].(string)
+
+		if err = DeleteAccount(backend, id, email); err != nil {
+			backend.Logger.Println("PURGE:", id, err)
+			continue
+		}
+
+		purged++
+	}
+
+	return purged, nil
+}
+
+// DeleteAccount removes the user document, the sessions and the api keys of the user
+func DeleteAccount(backend *Backend, id string, email string) error {
+	if _, err := NewCouch(backend.Couchdb, backend.Userdb).Delete(id); err != nil {
+		return err
+	}
+
+	creds := &Credentials{Backend: backend, Username: email}
+	creds.RevokeSessions()
+
+	if backend.Keydb != "" {
+		keys := NewCouch(backend.Couchdb, backend.Keydb)
+		owned, _ := keys.Find(map[string]interface{}{"owner": email})
+
+		for _, key := range owned {
+			if keyID, ok := key.(map[string]interface{})["_id"].(string); ok {
+				keys.Delete(keyID)
+			}
+		}
+	}
+
+	return nil
+}
+
+// restoreCode generates the random code that restores a cancelled account
+func restoreCode() string {
+	return randomHex(20)
+}
+
+func (c *Cancel) allowedLink(link string) bool {
+	mail := &Mail{MailConfig: c.MailConfig}
+	return mail.allowedDomain(link)
+}
+
+// hashRestoreCode hashes the restore code so the user document doesn't hold a usable code
+func hashRestoreCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
@@ -1,13 +1,17 @@
 package gouncer
 
 import (
+	"encoding/json"
 	"net/http"
 	"strings"
 )
 
 type Confirm struct {
 	*Backend
-	Handler *ResponseHandler
+	*Core
+	*MailConfig
+	Registrations map[string]Registration
+	Handler       *ResponseHandler
 }
 
 func NewConfirm(h *ResponseHandler) *Confirm {
@@ -18,13 +22,46 @@ func NewConfirm(h *ResponseHandler) *Confirm {
 func (c *Confirm) Registration() {
 	segs := strings.Split(c.Handler.HttpRequest.URL.Path, "/")
 
-	if item, err := c.Backend.Cache.Get(segs[len(segs)-1]); err == nil {
+	if item, err := c.Backend.CacheGet(RegistrationCache, segs[len(segs)-1]); err == nil {
 		doc := item.Value
 
+		var info RegistrationInfo
+		json.Unmarshal(doc, &info)
+
+		// The address might have been taken since the registration was submitted
+		if exists, err := UserExists(c.Backend, info.Email); exists || err != nil {
+			c.rejectRegistration(segs[len(segs)-1], info, err)
+			return
+		}
+
 		couch := NewCouch(c.Backend.Couchdb, c.Backend.Userdb)
 		if _, err := couch.Post(doc); err == nil {
+			if err = ClaimEmail(c.Backend, info.Email, info.Id); err != nil {
+				if _, derr := couch.Delete(info.Id); derr != nil {
+					c.Backend.Logger.Println("REGISTRATION:", derr)
+				}
+
+				c.rejectRegistration(segs[len(segs)-1], info, err)
+				return
+			}
+
 			// If the user object was correctly saved to the backend we delete the cache entry
-			c.Backend.Cache.Delete(segs[len(segs)-1])
+			c.Backend.CacheDelete(RegistrationCache, segs[len(segs)-1])
+			ClearPendingRegistration(c.Backend, info.Email)
+
+			// Redeem the invitation the user registered with
+			if info.Invite != "" {
+				if err := UseInvitation(c.Backend, info.Invite); err != nil {
+					c.Backend.Logger.Println("INVITATION:", err)
+				}
+			}
+
+			// Accounts awaiting approval are announced to the approvers
+			if info.Status == pendingStatus {
+				NotifyApprovers(c.Backend, c.Core, c.MailConfig, c.Registrations, info.Email)
+				c.Handler.NewResponse(http.StatusOK, "Registration successfull. Your account is awaiting approval. You will receive an email once it has been reviewed.")
+				return
+			}
 
 			// Respond to the user
 			c.Handler.NewResponse(http.StatusOK, "Registration successfull. You can now login with your new account.")
@@ -36,3 +73,15 @@ func (c *Confirm) Registration() {
 		c.Handler.NewError(http.StatusInternalServerError, err.Error())
 	}
 }
+
+// rejectRegistration drops the registration when the address is already in use
+func (c *Confirm) rejectRegistration(code string, info RegistrationInfo, err error) {
+	if err != nil && err != errUserExists {
+		c.Handler.NewError(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.Backend.CacheDelete(RegistrationCache, code)
+	ClearPendingRegistration(c.Backend, info.Email)
+	c.Handler.NewError(http.StatusConflict, errUserExists.Error())
+}
@@ -7,11 +7,15 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strings"
 )
 
 const (
 	bulk_option = "/_all_docs?include_docs=true"
+	find_option = "/_find"
+	view_option = "/_view/"
+	find_limit  = 10000 // Mango queries return 25 documents unless told otherwise
 )
 
 type CouchDB struct {
@@ -65,12 +69,96 @@ func (couch *CouchDB) Post(document []byte) (map[string]interface{}, error) {
 	if err == nil {
 		var data = make(map[string]interface{})
 		err = DecodeJsonRequest(response.Body, &data)
+
+		if err == nil && response.StatusCode >= 300 {
+			err = errors.New(response.Status)
+		}
+
 		return data, err
 	}
 
 	return nil, err
 }
 
+// Find runs a mango query with the selector and returns the matching documents
+func (couch *CouchDB) Find(selector map[string]interface{}) ([]interface{}, error) {
+	return couch.Query(selector, find_limit, 0)
+}
+
+// Query runs a mango query with the selector and returns a page of the matching documents
+func (couch *CouchDB) Query(selector map[string]interface{}, limit int, skip int) ([]interface{}, error) {
+	body, err := json.Marshal(map[string]interface{}{"selector": selector, "limit": limit, "skip": skip})
+
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := http.Post(couch.url()+find_option, "application/json", bytes.NewReader(body))
+
+	if err == nil {
+		var result = make(map[string]interface{})
+		err = DecodeJsonRequest(response.Body, &result)
+
+		if err == nil && response.StatusCode != 200 {
+			err = errors.New(response.Status)
+		}
+
+		docs, _ := result["docs"].([]interface{})
+		return docs, err
+	}
+
+	return nil, err
+}
+
+// View queries the design document view for the key and returns the matching documents
+func (couch *CouchDB) View(design string, view string, key string) ([]interface{}, error) {
+	k, err := json.Marshal(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := http.Get(couch.url() + "/_design/" + design + view_option + view + "?include_docs=true&key=" + url.QueryEscape(string(k)))
+
+	if err == nil {
+		defer response.Body.Close()
+
+		if response.StatusCode != 200 {
+			return nil, errors.New(response.Status)
+		}
+
+		return couch.parseBulkResponse(response.Body)
+	}
+
+	return nil, err
+}
+
+// AllDocs retrieves every document in the database. Design documents are left out
+func (couch *CouchDB) AllDocs() ([]interface{}, error) {
+	response, err := http.Get(couch.bulkUrl())
+
+	if err == nil {
+		defer response.Body.Close()
+
+		if response.StatusCode != 200 {
+			return nil, errors.New(response.Status)
+		}
+
+		var docs []interface{}
+		all, err := couch.parseBulkResponse(response.Body)
+
+		for _, doc := range all {
+			if id, _ := doc.(map[string]interface{})["_id"].(string); !strings.HasPrefix(id, "_design/") {
+				docs = append(docs, doc)
+			}
+		}
+
+		return docs, err
+	}
+
+	return nil, err
+}
+
 func (couch *CouchDB) Delete(id string) (map[string]interface{}, error) {
 	var err error
 	doc, getErr := couch.Get(id)
@@ -3,6 +3,7 @@ package gouncer
 import (
 	"bytes"
 	"crypto"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
@@ -13,7 +14,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/bradfitz/gomemcache/memcache"
 	"github.com/npolar/toki"
 )
 
@@ -22,6 +22,10 @@ const (
 	bearerPattern = "(?i)^Bearer\\s([a-zA-Z0-9-_]+\\.[a-zA-Z0-9-_]+\\.[a-zA-Z0-9-_]+)$"
 )
 
+const actorSeparator = "#act:" // Separates the user and the actor in the session key of impersonation tokens
+
+var errImpersonation = errors.New("Impersonation tokens can't be used to change credentials")
+
 var sysRegex = regexp.MustCompile(`^http(?:s)?\://(.[^/]+)/(.*[^\*]/?)?(\*)?$`)
 
 type Credentials struct {
@@ -35,6 +39,7 @@ type Credentials struct {
 	*Backend
 	Jwt      *toki.JsonWebToken
 	UserInfo map[string]interface{}
+	Actor    string // Admin acting as the user when the token is an impersonation token
 }
 
 type CacheObj struct {
@@ -148,8 +153,42 @@ func (creds *Credentials) GenerateHash(content string) string {
 }
 
 func (creds *Credentials) GenerateUserKey() string {
+	return userKey(creds.Username)
+}
+
+// sessionKey identifies the token session in the cache. Impersonation sessions are kept apart
+// from the sessions of the user so they can't be mistaken for or replace each other.
+func (creds *Credentials) sessionKey() string {
+	if creds.Actor != "" {
+		return creds.Username + actorSeparator + creds.Actor
+	}
+
+	return creds.Username
+}
+
+// sessionKeyListID returns the ID of the read key list belonging to the token session
+func (creds *Credentials) sessionKeyListID() string {
+	return userKey(creds.sessionKey())
+}
+
+// userID returns the stable id of the validated user. Legacy documents keyed by the email
+// address don't have one yet.
+func (creds *Credentials) userID() string {
+	if id, exists := creds.UserInfo["_id"].(string); exists && !legacyUser(creds.UserInfo) {
+		return id
+	}
+
+	return ""
+}
+
+// Impersonated checks if the validated token was issued to an admin acting as the user
+func (creds *Credentials) Impersonated() bool {
+	return creds.Actor != ""
+}
+
+func userKey(name string) string {
 	summer := crypto.MD5.New()
-	io.Copy(summer, bytes.NewReader([]byte(creds.Username)))
+	io.Copy(summer, bytes.NewReader([]byte(name)))
 	return hex.EncodeToString(summer.Sum(nil))
 }
 
@@ -169,8 +208,7 @@ func (creds *Credentials) ResolveHashAlg(hash string) {
 
 // FetchUser gets the user info from the database
 func (creds *Credentials) FetchUser() (map[string]interface{}, error) {
-	couch := NewCouch(creds.Couchdb, creds.Userdb)
-	doc, err := couch.Get(creds.Username)
+	doc, err := FetchUserByEmail(creds.Backend, creds.Username)
 
 	if err != nil {
 		err = errors.New("Error retrieving user info")
@@ -180,28 +218,138 @@ func (creds *Credentials) FetchUser() (map[string]interface{}, error) {
 }
 
 // ResolveGroupsToSystems checks the group info for the user and translates it into a
-// a list of systems that user has access to with the access rights they have on that system
+// a list of systems that user has access to with the access rights they have on that system.
+// Memberships and system entries outside their validity period are skipped.
 func (creds *Credentials) ResolveGroupsToSystems(groups []interface{}) []interface{} {
+	systems, _ := creds.groupSystems(groups)
+	return systems
+}
+
+// groupSystems resolves the systems of the active groups and returns the group each system came from
+func (creds *Credentials) groupSystems(groups []interface{}) ([]interface{}, []string) {
+	var systems []interface{}
+	var sources []string
+
+	ids := creds.ActiveGroups(groups)
+	if len(ids) == 0 {
+		return systems, sources
+	}
+
 	couch := NewCouch(creds.Couchdb, creds.Groupdb)
-	docs, err := couch.GetMultiple(groups)
+	docs, err := couch.GetMultiple(ids)
 
 	if err != nil {
 		creds.Logger.Println("Error resolving groups: ", err)
 	}
 
-	var systems []interface{}
-
 	if err == nil {
 		for _, doc := range docs {
-			if systemList, exists := doc.(map[string]interface{})["systems"]; exists {
-				for _, s := range systemList.([]interface{}) {
+			group := doc.(map[string]interface{})
+			if systemList, exists := group["systems"]; exists {
+				id, _ := group["_id"].(string)
+				for _, s := range creds.ActiveSystems(systemList.([]interface{})) {
 					systems = append(systems, s)
+					sources = append(sources, "group:"+id)
 				}
 			}
 		}
 	}
 
-	return systems
+	return systems, sources
+}
+
+// ActiveGroups returns the ids of the group memberships that are currently valid. Memberships
+// are either plain group ids or objects like {"id": "group", "not_before": "...", "not_after": "..."}
+func (creds *Credentials) ActiveGroups(groups []interface{}) []interface{} {
+	var ids []interface{}
+	now := time.Now()
+
+	for _, grp := range groups {
+		switch g := grp.(type) {
+		case string:
+			ids = append(ids, g)
+		case map[string]interface{}:
+			if id, ok := g["id"].(string); ok && GrantActive(g, now) {
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	return ids
+}
+
+// ActiveSystems filters out the system entries that are outside their validity period
+func (creds *Credentials) ActiveSystems(systems []interface{}) []interface{} {
+	var active []interface{}
+	now := time.Now()
+
+	for _, sys := range systems {
+		if entry, ok := sys.(map[string]interface{}); ok && GrantActive(entry, now) {
+			active = append(active, sys)
+		}
+	}
+
+	return active
+}
+
+// GrantsExpiry returns the earliest not_after of the users active group memberships and the
+// active systems. The boolean is false when none of the grants expire.
+func (creds *Credentials) GrantsExpiry(userInfo map[string]interface{}, systems []interface{}) (time.Time, bool) {
+	var earliest time.Time
+	var grants []interface{}
+	now := time.Now()
+
+	if groups, exists := userInfo["groups"].([]interface{}); exists {
+		grants = append(grants, groups...)
+	}
+
+	grants = append(grants, systems...)
+
+	for _, grant := range grants {
+		if entry, ok := grant.(map[string]interface{}); ok && GrantActive(entry, now) {
+			if notAfter, ok := parseGrantTime(entry["not_after"]); ok && (earliest.IsZero() || notAfter.Before(earliest)) {
+				earliest = notAfter
+			}
+		}
+	}
+
+	return earliest, !earliest.IsZero()
+}
+
+// GrantActive checks the optional not_before and not_after timestamps of a grant. Timestamps
+// can be RFC3339 strings, dates (2006-01-02) or unix seconds. Grants with a timestamp that can't
+// be parsed are inactive, so a typo never extends a grant.
+func GrantActive(grant map[string]interface{}, now time.Time) bool {
+	if value, exists := grant["not_before"]; exists {
+		if notBefore, ok := parseGrantTime(value); !ok || now.Before(notBefore) {
+			return false
+		}
+	}
+
+	if value, exists := grant["not_after"]; exists {
+		if notAfter, ok := parseGrantTime(value); !ok || !now.Before(notAfter) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func parseGrantTime(value interface{}) (time.Time, bool) {
+	switch v := value.(type) {
+	case string:
+		if t, err := time.Parse(time.RFC3339, v); err == nil {
+			return t, true
+		}
+
+		if t, err := time.Parse("2006-01-02", v); err == nil {
+			return t, true
+		}
+	case float64:
+		return time.Unix(int64(v), 0), true
+	}
+
+	return time.Time{}, false
 }
 
 // ValidCredentials returns true if the token or basic auth info provided is valid
@@ -224,6 +372,14 @@ func (creds *Credentials) ValidBasicAuth() (bool, error) {
 			return false, errors.New("Invalid user object. Missing 'active' key.")
 		}
 
+		if userInfo["status"] == pendingStatus {
+			return false, errors.New("This account is awaiting approval.")
+		}
+
+		if userInfo["status"] == cancelledStatus {
+			return false, errors.New("This account was cancelled and is scheduled for deletion.")
+		}
+
 		if userInfo["active"].(bool) == true {
 			var valid bool
 
@@ -238,7 +394,7 @@ func (creds *Credentials) ValidBasicAuth() (bool, error) {
 
 			// If the regular password isn't valid check for a cached one time pass
 			if !valid {
-				item, cerr := creds.Cache.Get(creds.Username)
+				item, cerr := creds.CacheGet(OneTimeCache, creds.Username)
 				err = cerr
 
 				if err == nil {
@@ -266,14 +422,25 @@ func (creds *Credentials) ValidToken() (bool, error) {
 	err := creds.parseToken()
 
 	if err == nil {
-		creds.Username = creds.Jwt.Claim.Content["email"].(string)
-		userInfo, uerr := creds.FetchUser() // load the user info for token generation purposes
+		if exp, ok := creds.Jwt.Claim.Content["exp"].(float64); ok && time.Now().Unix() >= int64(exp) {
+			return false, errors.New("Token expired")
+		}
+
+		creds.Actor = ""
+
+		if act, exists := creds.Jwt.Claim.Content["act"].(map[string]interface{}); exists {
+			if creds.Actor, _ = act["email"].(string); creds.Actor == "" {
+				return false, errors.New("Invalid actor claim")
+			}
+		}
+
+		userInfo, uerr := creds.tokenUser() // load the user info for token generation purposes
 		err = uerr
 
 		if err == nil {
 			creds.UserInfo = userInfo
 
-			item, cerr := creds.Cache.Get(creds.Username)
+			item, cerr := creds.CacheGet(SecretCache, creds.sessionKey())
 			err = cerr
 
 			if err == nil {
@@ -289,6 +456,89 @@ func (creds *Credentials) ValidToken() (bool, error) {
 	return false, err
 }
 
+// tokenUser loads the user the token was issued to and sets the username. Tokens carry the
+// stable user id in the sub claim. Legacy tokens without it are resolved through the email claim.
+func (creds *Credentials) tokenUser() (map[string]interface{}, error) {
+	claims := creds.Jwt.Claim.Content
+
+	if _, exists := claims["sub"]; !exists {
+		email, ok := claims["email"].(string)
+		if !ok || email == "" {
+			return nil, errors.New("Invalid email claim")
+		}
+
+		creds.Username = email
+		return creds.FetchUser()
+	}
+
+	id, ok := claims["sub"].(string)
+	if !ok {
+		return nil, errors.New("Invalid subject claim")
+	}
+
+	userInfo, err := FetchUserByID(creds.Backend, id)
+	if err != nil {
+		return nil, errors.New("Error retrieving user info")
+	}
+
+	email, ok := userInfo["email"].(string)
+	if !ok || email == "" {
+		return nil, errors.New("Error retrieving user info")
+	}
+
+	// Sessions are keyed by the address the token was issued for. After an email change the
+	// session no longer exists under the current address, so the token stops working.
+	creds.Username = email
+	if claim, _ := claims["email"].(string); strings.EqualFold(claim, email) {
+		creds.Username = claim
+	}
+
+	return userInfo, nil
+}
+
+// TokenSystems returns the systems of a validated token. Compact tokens only carry a reference
+// to the systems list which is then loaded from the cache and checked against the hash in the token.
+func (creds *Credentials) TokenSystems() ([]interface{}, error) {
+	var systems []interface{}
+
+	if sys, exists := creds.Jwt.Claim.Content["systems"].([]interface{}); exists {
+		return sys, nil
+	}
+
+	ref, exists := creds.Jwt.Claim.Content["systems_ref"].(string)
+	if !exists {
+		return systems, nil
+	}
+
+	item, err := creds.CacheGet(SystemsCache, ref)
+	if err != nil {
+		return systems, errors.New("Unable to load the token systems. Please reauthenticate.")
+	}
+
+	if hash, _ := creds.Jwt.Claim.Content["systems_hash"].(string); hash != creds.systemsHash(item.Value) {
+		return systems, errors.New("Token systems do not match the token")
+	}
+
+	err = json.Unmarshal(item.Value, &systems)
+	return systems, err
+}
+
+// StoreSystems caches the systems list server side and returns the reference and hash to put in the token
+func (creds *Credentials) StoreSystems(systems []interface{}, exp int32) (string, string, error) {
+	data, err := json.Marshal(systems)
+	if err != nil {
+		return "", "", err
+	}
+
+	ref := creds.GenerateUserKey() + "-" + randomHex(16)
+	return ref, creds.systemsHash(data), creds.CacheCredentials(SystemsCache, ref, data, exp)
+}
+
+func (creds *Credentials) systemsHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
 func (creds *Credentials) CacheKeyList(kl *KeyList, exp int32) {
 	l, err := json.Marshal(kl)
 
@@ -296,15 +546,62 @@ func (creds *Credentials) CacheKeyList(kl *KeyList, exp int32) {
 		creds.Logger.Println("KEY LIST ENCODING:", err)
 	}
 
-	err = creds.CacheCredentials(kl.ID, l, exp)
+	err = creds.CacheCredentials(KeyListCache, kl.ID, l, exp)
 
 	if err != nil {
 		creds.Logger.Println("KEY CACHE:", err)
 	}
 }
 
-func (creds *Credentials) CacheCredentials(k string, v []byte, exp int32) error {
-	return creds.Cache.Set(&memcache.Item{Key: k, Value: v, Expiration: exp})
+// CacheCredentials stores the value under the key in the cache namespace
+func (creds *Credentials) CacheCredentials(ns CacheNamespace, k string, v []byte, exp int32) error {
+	return creds.CacheSet(ns, k, v, exp)
+}
+
+// RevokeSessions drops the token secrets and read keys of the user, including impersonation
+// sessions, so every issued token stops working
+func (creds *Credentials) RevokeSessions() {
+	creds.CacheDelete(SecretCache, creds.Username)
+	creds.CacheDelete(KeyListCache, creds.GenerateUserKey())
+
+	for _, actor := range creds.sessionActors() {
+		session := &Credentials{Username: creds.Username, Actor: actor}
+		creds.CacheDelete(SecretCache, session.sessionKey())
+		creds.CacheDelete(KeyListCache, session.sessionKeyListID())
+	}
+
+	creds.CacheDelete(ActorCache, creds.Username)
+}
+
+// TrackActor records the actor of an impersonation session so the session can be revoked along
+// with the sessions of the user
+func (creds *Credentials) TrackActor(exp int32) error {
+	actors := creds.sessionActors()
+
+	for _, actor := range actors {
+		if actor == creds.Actor {
+			return nil
+		}
+	}
+
+	data, err := json.Marshal(append(actors, creds.Actor))
+
+	if err == nil {
+		err = creds.CacheSet(ActorCache, creds.Username, data, exp)
+	}
+
+	return err
+}
+
+// sessionActors returns the admins with an impersonation session for the user
+func (creds *Credentials) sessionActors() []string {
+	var actors []string
+
+	if item, err := creds.CacheGet(ActorCache, creds.Username); err == nil {
+		json.Unmarshal(item.Value, &actors)
+	}
+
+	return actors
 }
 
 func (creds *Credentials) parseToken() error {
@@ -0,0 +1,137 @@
+package gouncer
+
+import (
+	"errors"
+	"net/mail"
+	"sort"
+	"strings"
+)
+
+const (
+	defaultRegistration = "default" // Domain of the fallback registration rule
+)
+
+// EmailDomain parses a bare email address and returns its lowercased domain
+func EmailDomain(email string) (string, error) {
+	addr, err := mail.ParseAddress(email)
+
+	if err != nil || addr.Address != strings.TrimSpace(email) {
+		return "", errors.New("Invalid email address")
+	}
+
+	at := strings.LastIndex(addr.Address, "@")
+	domain := strings.ToLower(addr.Address[at+1:])
+
+	if !strings.Contains(domain, ".") || strings.HasPrefix(domain, ".") || strings.HasSuffix(domain, ".") {
+		return "", errors.New("Invalid email domain")
+	}
+
+	return domain, nil
+}
+
+// Matches checks if the registration rule applies to the domain. Rules can match a domain exactly
+// ("npolar.no"), any subdomain through a wildcard ("*.npolar.no") or a domain and all of its
+// subdomains when Subdomains is set.
+func (reg Registration) Matches(domain string) bool {
+	rule := strings.ToLower(strings.TrimSpace(reg.Domain))
+
+	switch {
+	case rule == "" || rule == defaultRegistration:
+		return false
+	case rule == "*":
+		return true
+	case strings.HasPrefix(rule, "*."):
+		return strings.HasSuffix(domain, rule[1:])
+	case domain == rule:
+		return true
+	default:
+		return reg.Subdomains && strings.HasSuffix(domain, "."+rule)
+	}
+}
+
+// MatchRegistration merges the registration rules matching the domain of the email address. Rules
+// are evaluated from the highest to the lowest priority. Groups and approvers of all matching rules
+// are merged and any of them can require approval. A matching deny rule rejects the address and
+// a final rule stops the evaluation of lower priority rules. The default rule only applies when
+// nothing else matched.
+func MatchRegistration(registrations map[string]Registration, email string) (Registration, error) {
+	var merged Registration
+
+	domain, err := EmailDomain(email)
+	if err != nil {
+		return merged, err
+	}
+
+	merged.Domain = domain
+
+	var names []string
+	for name := range registrations {
+		names = append(names, name)
+	}
+
+	// Highest priority first. Ties are resolved on the rule name to keep the outcome stable
+	sort.Slice(names, func(i, j int) bool {
+		a, b := registrations[names[i]], registrations[names[j]]
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		return names[i] < names[j]
+	})
+
+	matched := false
+
+	for _, name := range names {
+		reg := registrations[name]
+
+		if !reg.Matches(domain) {
+			continue
+		}
+
+		if reg.Deny {
+			return merged, errors.New("Registrations from " + domain + " are not allowed")
+		}
+
+		matched = true
+		merged.merge(reg)
+
+		if reg.Final {
+			break
+		}
+	}
+
+	if !matched {
+		for name, reg := range registrations {
+			if name == defaultRegistration || reg.Domain == defaultRegistration {
+				merged.merge(reg)
+			}
+		}
+	}
+
+	return merged, nil
+}
+
+// merge adds the groups, approvers and approval requirement of the rule without duplicates
+func (reg *Registration) merge(rule Registration) {
+	reg.Groups = appendUnique(reg.Groups, rule.Groups...)
+	reg.Approvers = appendUnique(reg.Approvers, rule.Approvers...)
+	reg.Approval = reg.Approval || rule.Approval
+}
+
+func appendUnique(list []string, items ...string) []string {
+	for _, item := range items {
+		exists := false
+
+		for _, existing := range list {
+			if existing == item {
+				exists = true
+				break
+			}
+		}
+
+		if !exists {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
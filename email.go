@@ -0,0 +1,254 @@
+package gouncer
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// EmailChange lets users move their account to a new email address
+type EmailChange struct {
+	Credentials
+	*ResponseHandler
+	*Core
+	*MailConfig
+	Registrations map[string]Registration
+}
+
+// EmailChangeRequest holds the new address and an optional confirmation link
+type EmailChangeRequest struct {
+	Email string `json:"email"`
+	Link  string `json:"link,omitempty"`
+}
+
+// emailChange is the cached change request waiting for confirmation from the new address
+type emailChange struct {
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+func NewEmailChange(h *ResponseHandler) *EmailChange {
+	return &EmailChange{ResponseHandler: h}
+}
+
+// Request validates the credentials and mails a confirmation code to the new address
+func (e *EmailChange) Request() {
+	err := e.ParseAuthHeader(e.HttpRequest.Header.Get("Authorization"))
+
+	if err == nil {
+		var valid bool
+		if valid, err = e.ValidCredentials(); valid {
+			if e.Impersonated() {
+				e.NewError(http.StatusForbidden, errImpersonation.Error())
+				return
+			}
+
+			var req EmailChangeRequest
+			if err = DecodeJsonRequest(e.HttpRequest.Body, &req); err == nil {
+				e.processRequest(req)
+			} else {
+				e.NewError(http.StatusBadRequest, err.Error())
+			}
+			return
+		} else if err == nil {
+			err = errors.New("Invalid credentials")
+		}
+	}
+
+	e.NewError(http.StatusUnauthorized, err.Error())
+}
+
+func (e *EmailChange) processRequest(req EmailChangeRequest) {
+	email := strings.ToLower(strings.TrimSpace(req.Email))
+
+	if _, err := EmailDomain(email); err != nil {
+		e.NewError(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if email == e.Username {
+		e.NewError(http.StatusBadRequest, "The new address is the same as the current one")
+		return
+	}
+
+	// The domain rules that apply to registrations apply to address changes as well
+	if _, err := MatchRegistration(e.Registrations, email); err != nil {
+		e.NewError(http.StatusForbidden, err.Error())
+		return
+	}
+
+	if exists, err := UserExists(e.Backend, email); exists {
+		e.NewError(http.StatusConflict, "This user already exists.")
+		return
+	} else if err != nil {
+		e.NewError(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	data, err := json.Marshal(&emailChange{Old: e.Username, New: email})
+
+	code := randomHex(20)
+
+	if err == nil {
+		err = e.CacheCredentials(EmailCache, code, data, e.LinkTimeout)
+	}
+
+	if err == nil {
+		mail := NewMailClient(email, code)
+		mail.MailConfig = e.MailConfig
+		mail.Backend = e.Backend
+		mail.Core = e.Core
+
+		err = mail.EmailChange(req.Link)
+	}
+
+	if err != nil {
+		e.NewError(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	e.NewResponse(http.StatusOK, "In a few moments you will receive a confirmation email at: "+email+". Use the code inside to complete the change.")
+}
+
+// Confirm moves the account to the new address after the code in the last path segment was
+// confirmed. Sessions for the old address are revoked and the old address is notified.
+func (e *EmailChange) Confirm() {
+	var change emailChange
+
+	segs := strings.Split(strings.Trim(e.HttpRequest.URL.Path, "/"), "/")
+	code := segs[len(segs)-1]
+
+	item, err := e.CacheGet(EmailCache, code)
+
+	if err == nil {
+		err = json.Unmarshal(item.Value, &change)
+	}
+
+	if err != nil {
+		e.NewError(http.StatusNotFound, "Unknown or expired confirmation code")
+		return
+	}
+
+	if err = MigrateUser(e.Backend, change.Old, change.New); err == errUserExists {
+		e.CacheDelete(EmailCache, code)
+		e.NewError(http.StatusConflict, err.Error())
+		return
+	} else if err != nil {
+		e.NewError(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	e.CacheDelete(EmailCache, code)
+
+	// Revoke the sessions of the old address
+	e.Username = change.Old
+	e.RevokeSessions()
+
+	mail := NewMailClient(change.Old, "")
+	mail.MailConfig = e.MailConfig
+	mail.Backend = e.Backend
+	mail.Core = e.Core
+
+	if err = mail.EmailChanged(change.New); err != nil {
+		e.Logger.Println("EMAIL CHANGE:", err)
+	}
+
+	e.NewResponse(http.StatusOK, "Your email address was changed to: "+change.New+". Please login with your new address.")
+}
+
+// saveUserDocument stores the user document and updates its revision
+func saveUserDocument(couch *CouchDB, doc map[string]interface{}) error {
+	data, err := json.Marshal(doc)
+
+	if err == nil {
+		var resp map[string]interface{}
+		if resp, err = couch.Post(data); err == nil {
+			doc["_rev"] = resp["rev"]
+		}
+	}
+
+	return err
+}
+
+// MigrateUser moves the account to the new address and transfers the api keys and group
+// ownerships. Accounts that still use the old address as id receive an opaque user id.
+func MigrateUser(backend *Backend, old string, email string) error {
+	couch := NewCouch(backend.Couchdb, backend.Userdb)
+
+	if exists, err := UserExists(backend, email); exists {
+		return errUserExists
+	} else if err != nil {
+		return err
+	}
+
+	doc, err := FetchUserByEmail(backend, old)
+	if err != nil {
+		return errors.New("Error retrieving user info")
+	}
+
+	doc["email"] = email
+
+	if legacyUser(doc) {
+		err = rekeyUser(couch, doc, NewUserID())
+	} else {
+		err = saveUserDocument(couch, doc)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// Another account might have claimed the address in the meantime. Move back to the old address if so.
+	if err = ClaimEmail(backend, email, doc["_id"].(string)); err != nil {
+		if current, gerr := couch.Get(doc["_id"].(string)); gerr == nil {
+			current["email"] = old
+			if serr := saveUserDocument(couch, current); serr != nil {
+				backend.Logger.Println("EMAIL CHANGE:", serr)
+			}
+		}
+
+		return err
+	}
+
+	if backend.Keydb != "" {
+		migrateDocuments(backend, NewCouch(backend.Couchdb, backend.Keydb), map[string]interface{}{"owner": old}, func(doc map[string]interface{}) {
+			doc["owner"] = email
+		})
+	}
+
+	migrateDocuments(backend, NewCouch(backend.Couchdb, backend.Groupdb), map[string]interface{}{"owners": map[string]interface{}{"$elemMatch": map[string]interface{}{"$eq": old}}}, func(doc map[string]interface{}) {
+		owners, _ := doc["owners"].([]interface{})
+		for i, owner := range owners {
+			if owner == old {
+				owners[i] = email
+			}
+		}
+	})
+
+	return nil
+}
+
+// migrateDocuments applies the update to every document matching the selector. Failures are
+// logged since the account itself has already moved.
+func migrateDocuments(backend *Backend, couch *CouchDB, selector map[string]interface{}, update func(map[string]interface{})) {
+	docs, err := couch.Find(selector)
+
+	for _, d := range docs {
+		doc := d.(map[string]interface{})
+		update(doc)
+
+		var data []byte
+		if data, err = json.Marshal(doc); err == nil {
+			_, err = couch.Post(data)
+		}
+
+		if err != nil {
+			backend.Logger.Println("USER MIGRATION:", doc["_id"], err)
+		}
+	}
+
+	if err != nil && len(docs) == 0 {
+		backend.Logger.Println("USER MIGRATION:", err)
+	}
+}
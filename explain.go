@@ -0,0 +1,155 @@
+package gouncer
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+)
+
+// AuthorizationTrace describes how an authorization decision was reached
+type AuthorizationTrace struct {
+	System     string       `json:"system" xml:"System"`
+	Access     bool         `json:"access" xml:"Access"`
+	Reason     string       `json:"reason" xml:"Reason"`
+	Winner     *TraceEntry  `json:"winner,omitempty" xml:"Winner,omitempty"`
+	Considered []TraceEntry `json:"considered" xml:"Considered>Entry"`
+}
+
+// TraceEntry is a single access list entry considered during authorization
+type TraceEntry struct {
+	Source     string                 `json:"source" xml:"source,attr"` // group:<id> | user | token
+	Uri        string                 `json:"uri" xml:"uri,attr"`
+	Rights     interface{}            `json:"rights,omitempty" xml:"Right,omitempty"`
+	Match      string                 `json:"match,omitempty" xml:"match,attr,omitempty"` // exact | wildcard
+	Policy     string                 `json:"policy,omitempty" xml:"Policy,omitempty"`
+	PolicyDeny string                 `json:"policy_denied,omitempty" xml:"PolicyDenied,omitempty"` // Why the policy denied access
+	Overridden bool                   `json:"overridden,omitempty" xml:"overridden,attr,omitempty"`
+	system     map[string]interface{} // The access list entry itself
+}
+
+func newTraceEntry(source string, system interface{}) TraceEntry {
+	entry := TraceEntry{Source: source}
+
+	if sys, ok := system.(map[string]interface{}); ok {
+		entry.Uri, _ = sys["uri"].(string)
+		entry.Rights = sys["rights"]
+		entry.Policy, _ = sys["policy"].(string)
+		entry.system = sys
+	}
+
+	return entry
+}
+
+// ExplainUser traces the authorization decision for a basic auth user. Group entries
+// that are overridden by a user level entry are listed but not used for matching.
+func (auth *Authorizer) ExplainUser(system string) *AuthorizationTrace {
+	accessList, considered := auth.resolveUserAccess()
+	return auth.trace(system, accessList, considered)
+}
+
+// ExplainToken traces the authorization decision for the systems embedded in the token
+func (auth *Authorizer) ExplainToken(system string) *AuthorizationTrace {
+	var considered []TraceEntry
+	accessList, _ := auth.TokenSystems()
+
+	for _, s := range accessList {
+		considered = append(considered, newTraceEntry("token", s))
+	}
+
+	return auth.trace(system, accessList, considered)
+}
+
+// trace annotates the considered entries and takes the decision from MatchEntry on the same
+// access list authorization uses, so the trace can't disagree with the actual decision.
+func (auth *Authorizer) trace(system string, accessList []interface{}, considered []TraceEntry) *AuthorizationTrace {
+	tr := &AuthorizationTrace{System: system, Considered: considered}
+	reqUrl, _ := url.Parse(system)
+
+	hostMatch := false
+	policyDenied := false
+	matches := 0
+
+	for i := range tr.Considered {
+		entry := &tr.Considered[i]
+
+		if sysUrl, err := url.Parse(entry.Uri); err == nil && reqUrl != nil && sysUrl.Host == reqUrl.Host {
+			hostMatch = true
+		}
+
+		if entry.Overridden {
+			continue
+		}
+
+		if entry.Match = auth.matchType(entry.Uri, reqUrl); entry.Match == "" {
+			continue
+		}
+
+		if allowed, err := auth.PolicyAllows(entry.system); !allowed {
+			entry.PolicyDeny = "policy evaluated to false"
+			if err != nil {
+				entry.PolicyDeny = err.Error()
+			}
+
+			policyDenied = true
+			continue
+		}
+
+		matches++
+	}
+
+	if winner, match := auth.MatchEntry(system, accessList); match {
+		tr.Access = true
+
+		for i := range tr.Considered {
+			if !tr.Considered[i].Overridden && sameEntry(tr.Considered[i].system, winner) {
+				w := tr.Considered[i]
+				tr.Winner = &w
+			}
+		}
+	}
+
+	switch {
+	case tr.Winner != nil:
+		tr.Reason = fmt.Sprintf("%s match on %s from %s", tr.Winner.Match, tr.Winner.Uri, tr.Winner.Source)
+
+		if matches > 1 {
+			tr.Reason += fmt.Sprintf(". It is the last of %d matching entries and takes precedence", matches)
+		}
+	case tr.Access:
+		tr.Reason = "Access granted"
+	case len(accessList) == 0:
+		tr.Reason = "No systems are available to this user"
+	case !hostMatch || reqUrl == nil:
+		tr.Reason = "No entry matches the host of the requested system"
+	case policyDenied:
+		tr.Reason = "Entries match the system but their policies denied access"
+	default:
+		tr.Reason = fmt.Sprintf("Entries exist for host %s but none match the path %s", reqUrl.Host, reqUrl.Path)
+	}
+
+	return tr
+}
+
+// sameEntry checks if both maps are the same access list entry
+func sameEntry(a map[string]interface{}, b map[string]interface{}) bool {
+	return a != nil && b != nil && reflect.ValueOf(a).Pointer() == reflect.ValueOf(b).Pointer()
+}
+
+// matchType returns how the entry uri matches the requested url (exact|wildcard) or an empty string
+func (auth *Authorizer) matchType(uri string, reqUrl *url.URL) string {
+	sysUrl, err := url.Parse(uri)
+
+	if err != nil || reqUrl == nil || sysUrl.Host != reqUrl.Host {
+		return ""
+	}
+
+	if auth.ExactPathMatch(sysUrl.Path, reqUrl.Path) {
+		return "exact"
+	}
+
+	if auth.WildcardPathMatch(sysUrl.Path, reqUrl.Path) {
+		return "wildcard"
+	}
+
+	return ""
+}
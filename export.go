@@ -0,0 +1,172 @@
+package gouncer
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AccountExport collects everything gouncer stores about an account
+type AccountExport struct {
+	Authorizer
+	*Core
+}
+
+// Archive is the data export of a single account
+type Archive struct {
+	Exported string                 `json:"exported"`
+	User     map[string]interface{} `json:"user"`
+	Groups   []interface{}          `json:"groups"`
+	Systems  []interface{}          `json:"systems"`
+	Sessions SessionInfo            `json:"sessions"`
+	ApiKeys  []ApiKey               `json:"api_keys,omitempty"`
+	Events   []AuditEvent           `json:"events,omitempty"`
+}
+
+// SessionInfo describes the cached session state of an account
+type SessionInfo struct {
+	Active         bool     `json:"active"`                     // A token secret is cached for the user
+	ReadKeySystems []string `json:"read_key_systems,omitempty"` // Systems the issued read keys are valid for
+}
+
+func NewAccountExport(h *ResponseHandler) *AccountExport {
+	return &AccountExport{Authorizer: Authorizer{ResponseHandler: h}}
+}
+
+// HandleRequest exports the account of the caller (/account/export) or, for admins, the
+// account in the last path segment (/account/export/<email>)
+func (e *AccountExport) HandleRequest() {
+	err := e.ParseAuthHeader(e.HttpRequest.Header.Get("Authorization"))
+
+	if err == nil {
+		var valid bool
+		if valid, err = e.ValidCredentials(); valid {
+			e.export(strings.Trim(strings.TrimPrefix(e.HttpRequest.URL.Path, "/account/export"), "/"))
+			return
+		} else if err == nil {
+			err = errors.New("Invalid credentials")
+		}
+	}
+
+	e.NewError(http.StatusUnauthorized, err.Error())
+}
+
+func (e *AccountExport) export(email string) {
+	user := e.UserInfo
+
+	if email != "" && !strings.EqualFold(email, e.Username) {
+		if !e.IsAdmin(e.AdminSystem) {
+			e.NewError(http.StatusForbidden, "Only admins can export other accounts")
+			return
+		}
+
+		var err error
+		if user, err = FetchUserByEmail(e.Backend, email); err != nil {
+			e.NewError(http.StatusNotFound, "Unknown user: "+email)
+			return
+		}
+	}
+
+	archive, err := BuildArchive(e.Backend, user)
+
+	if err != nil {
+		e.NewError(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	event := NewAuditEvent("export", e.HttpRequest)
+	event.Owner, _ = user["email"].(string)
+	event.Success = true
+	e.MarkActor(event)
+	e.Audit(event)
+
+	e.Writer.Header().Set("Content-Disposition", "attachment; filename=\"account-export.json\"")
+	e.Response.Status = http.StatusOK
+	e.Response.Archive = archive
+}
+
+// BuildArchive collects the user document (without password data), groups, systems, sessions,
+// api keys and audit events of the user
+func BuildArchive(backend *Backend, user map[string]interface{}) (*Archive, error) {
+	email, _ := user["email"].(string)
+	if email == "" {
+		email, _ = user["_id"].(string)
+	}
+
+	archive := &Archive{Exported: time.Now().UTC().Format(time.RFC3339), User: PublicUser(user)}
+
+	// Resolve the systems the same way authorization does
+	owner := &Authorizer{Credentials: Credentials{Backend: backend, Username: email, UserInfo: user}}
+	archive.Systems = owner.userAccessList()
+
+	if groups, exists := user["groups"].([]interface{}); exists {
+		var ids []interface{}
+		for _, grp := range groups {
+			switch g := grp.(type) {
+			case string:
+				ids = append(ids, g)
+			case map[string]interface{}:
+				ids = append(ids, g["id"])
+			}
+		}
+
+		if len(ids) > 0 {
+			docs, err := NewCouch(backend.Couchdb, backend.Groupdb).GetMultiple(ids)
+			if err != nil {
+				return nil, err
+			}
+
+			archive.Groups = docs
+		}
+	}
+
+	archive.Sessions = sessionInfo(&owner.Credentials)
+
+	if backend.Keydb != "" {
+		keys, err := OwnedApiKeys(backend, email)
+		if err != nil {
+			return nil, err
+		}
+
+		archive.ApiKeys = keys
+	}
+
+	if backend.Auditdb != "" {
+		events, err := backend.AuditEvents(map[string]interface{}{"owner": email})
+		if err != nil {
+			return nil, err
+		}
+
+		archive.Events = events
+	}
+
+	return archive, nil
+}
+
+// sessionInfo reports if the user holds a token secret and which systems the read keys cover
+func sessionInfo(creds *Credentials) SessionInfo {
+	var info SessionInfo
+
+	if _, err := creds.CacheGet(SecretCache, creds.Username); err == nil {
+		info.Active = true
+	}
+
+	if item, err := creds.CacheGet(KeyListCache, creds.GenerateUserKey()); err == nil {
+		var kList KeyList
+		if json.Unmarshal(item.Value, &kList) == nil {
+			seen := make(map[string]bool)
+			for _, system := range kList.Pairs {
+				if !seen[system] {
+					seen[system] = true
+					info.ReadKeySystems = append(info.ReadKeySystems, system)
+				}
+			}
+			sort.Strings(info.ReadKeySystems)
+		}
+	}
+
+	return info
+}
@@ -0,0 +1,41 @@
+package gouncer
+
+import "errors"
+
+// FetchGroup retrieves a group document from the group database
+func (creds *Credentials) FetchGroup(id string) (map[string]interface{}, error) {
+	couch := NewCouch(creds.Couchdb, creds.Groupdb)
+	doc, err := couch.Get(id)
+
+	if err != nil {
+		err = errors.New("Unknown group: " + id)
+	}
+
+	return doc, err
+}
+
+// OwnsGroups checks if the authenticated user is listed as owner of every group
+func (creds *Credentials) OwnsGroups(groups []string) bool {
+	for _, id := range groups {
+		group, err := creds.FetchGroup(id)
+
+		if err != nil || !GroupOwner(group, creds.Username) {
+			return false
+		}
+	}
+
+	return len(groups) > 0
+}
+
+// GroupOwner checks if the user appears in the owners list of the group document
+func GroupOwner(group map[string]interface{}, user string) bool {
+	owners, _ := group["owners"].([]interface{})
+
+	for _, owner := range owners {
+		if owner == user {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,84 @@
+package gouncer
+
+import (
+	"net/http"
+	"strings"
+)
+
+const (
+	defaultImpersonation = 900 // Default lifetime of impersonation tokens in seconds
+)
+
+// Impersonation lets admins request a short lived token for another user to see what they see.
+// The token carries an act claim with the admin and can't be used to change credentials.
+type Impersonation struct {
+	Admin
+	*Token
+}
+
+func NewImpersonation(h *ResponseHandler) *Impersonation {
+	return &Impersonation{Admin: Admin{Authorizer: Authorizer{ResponseHandler: h}}}
+}
+
+// HandleRequest checks the admin right and issues a token for the user in the path (/admin/impersonate/<email>)
+func (i *Impersonation) HandleRequest() {
+	if !i.authorize() {
+		return
+	}
+
+	args := i.pathArgs("/admin/impersonate")
+	if len(args) != 1 {
+		i.NewError(http.StatusBadRequest, "Please provide the email address of the user to impersonate")
+		return
+	}
+
+	email := strings.ToLower(args[0])
+
+	if email == i.Username {
+		i.NewError(http.StatusBadRequest, "You can't impersonate yourself")
+		return
+	}
+
+	user, err := FetchUserByEmail(i.Backend, email)
+
+	if err != nil {
+		i.NewError(http.StatusNotFound, "Unknown user: "+email)
+		return
+	}
+
+	if user["active"] != true || user["status"] == pendingStatus || user["status"] == cancelledStatus {
+		i.NewError(http.StatusConflict, "Only active accounts can be impersonated")
+		return
+	}
+
+	i.issue(email, user)
+}
+
+// issue generates the impersonation token and audits the request
+func (i *Impersonation) issue(email string, user map[string]interface{}) {
+	token := *i.Token
+	token.Expiration = i.Impersonation
+	if token.Expiration <= 0 {
+		token.Expiration = defaultImpersonation
+	}
+
+	auth := NewAuthenticator(i.ResponseHandler)
+	auth.Token = &token
+	auth.Backend = i.Backend
+	auth.Username = email
+	auth.Actor = i.Username
+
+	auth.TokenResponse(user)
+
+	event := NewAuditEvent("admin", i.HttpRequest)
+	event.Action = "impersonate"
+	event.Owner = email
+	event.Actor = i.Username
+	event.Success = i.Response.Status == http.StatusOK
+
+	if !event.Success {
+		event.Error = i.Response.Error
+	}
+
+	i.Audit(event)
+}
@@ -0,0 +1,195 @@
+package gouncer
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// RegistrationConfig holds the registration settings
+type RegistrationConfig struct {
+	InviteOnly     bool  // Only accept registrations with a valid invitation
+	InviteTimeout  int32 // Default lifetime of an invitation in seconds. Defaults to a week
+	ResendInterval int64 // Minimum seconds between confirmation mails for an address. Defaults to a minute
+	ResendLimit    int   // Confirmation mails that can be resent per registration. Defaults to 5
+	GracePeriod    int32 // Seconds a cancelled account can be restored before it's deleted. Defaults to 30 days
+	PurgeInterval  int32 // Seconds between purges of cancelled accounts. Defaults to an hour
+}
+
+// Inviter lets admins and group owners invite new users
+type Inviter struct {
+	Authorizer
+	*Core
+	*MailConfig
+	*RegistrationConfig
+}
+
+// InvitationRequest holds the invitation details submitted by the inviter
+type InvitationRequest struct {
+	Email   string   `json:"email"`
+	Groups  []string `json:"groups"`
+	Expires string   `json:"expires,omitempty"` // RFC3339 timestamp. Defaults to the configured invite timeout
+	Link    string   `json:"link,omitempty"`    // Registration link to include in the mail
+}
+
+// Invitation is the invitation document stored in the invitation database. The ID doubles as the invite code.
+type Invitation struct {
+	Id      string   `json:"_id"`
+	Rev     string   `json:"_rev,omitempty"`
+	Email   string   `json:"email"`
+	Groups  []string `json:"groups"`
+	Inviter string   `json:"inviter"`
+	Created string   `json:"created"`
+	Expires string   `json:"expires"`
+	Used    string   `json:"used,omitempty"`
+}
+
+func NewInviter(h *ResponseHandler) *Inviter {
+	return &Inviter{Authorizer: Authorizer{ResponseHandler: h}}
+}
+
+// Invite validates the inviter, stores the invitation and mails the invite code
+func (i *Inviter) Invite() {
+	err := i.ParseAuthHeader(i.HttpRequest.Header.Get("Authorization"))
+
+	if err == nil {
+		var valid bool
+		if valid, err = i.ValidCredentials(); valid {
+			var req InvitationRequest
+			if err = DecodeJsonRequest(i.HttpRequest.Body, &req); err == nil {
+				i.processInvitation(req)
+				return
+			}
+		} else if err == nil {
+			err = errors.New("Invalid credentials")
+		}
+	}
+
+	i.NewError(http.StatusUnauthorized, err.Error())
+}
+
+func (i *Inviter) processInvitation(req InvitationRequest) {
+	req.Email = strings.ToLower(strings.TrimSpace(req.Email))
+
+	if req.Email == "" || !strings.Contains(req.Email, "@") {
+		i.NewError(http.StatusBadRequest, "Please provide the email address of the invitee")
+		return
+	}
+
+	// Admins can invite to any group. Group owners only to the groups they own.
+	if !i.IsAdmin(i.AdminSystem) && !i.OwnsGroups(req.Groups) {
+		i.NewError(http.StatusForbidden, "Only admins and owners of the requested groups can send invitations")
+		return
+	}
+
+	for _, id := range req.Groups {
+		if _, err := i.FetchGroup(id); err != nil {
+			i.NewError(http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	lifetime := time.Duration(i.InviteTimeout) * time.Second
+	if lifetime <= 0 {
+		lifetime = 7 * 24 * time.Hour
+	}
+
+	expires := time.Now().Add(lifetime)
+
+	if req.Expires != "" {
+		exp, err := time.Parse(time.RFC3339, req.Expires)
+		if err != nil || exp.Before(time.Now()) {
+			i.NewError(http.StatusBadRequest, "Expires has to be a RFC3339 timestamp in the future")
+			return
+		}
+
+		expires = exp
+	}
+
+	invitation := &Invitation{
+		Id:      randomHex(20), // Doubles as the invite code so it has to be unguessable
+		Email:   req.Email,
+		Groups:  req.Groups,
+		Inviter: i.Username,
+		Created: time.Now().UTC().Format(time.RFC3339),
+		Expires: expires.UTC().Format(time.RFC3339),
+	}
+
+	doc, err := json.Marshal(invitation)
+
+	if err == nil {
+		couch := NewCouch(i.Couchdb, i.Invitedb)
+		_, err = couch.Post(doc)
+	}
+
+	if err == nil {
+		mail := NewMailClient(invitation.Email, invitation.Id)
+		mail.MailConfig = i.MailConfig
+		mail.Backend = i.Backend
+		mail.Core = i.Core
+
+		err = mail.Invitation(req.Link, i.Username)
+	}
+
+	if err != nil {
+		i.NewError(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	i.NewResponse(http.StatusCreated, "An invitation was sent to: "+invitation.Email)
+}
+
+// FetchInvitation retrieves an invitation and checks that it can still be used by the email address
+func FetchInvitation(backend *Backend, code string, email string) (*Invitation, error) {
+	var invitation Invitation
+
+	if backend.Invitedb == "" {
+		return nil, errors.New("Invitations are not enabled on this server")
+	}
+
+	doc, err := NewCouch(backend.Couchdb, backend.Invitedb).Get(code)
+
+	if err == nil {
+		var raw []byte
+		if raw, err = json.Marshal(doc); err == nil {
+			err = json.Unmarshal(raw, &invitation)
+		}
+	}
+
+	if err != nil {
+		return nil, errors.New("Invalid invitation")
+	}
+
+	if invitation.Used != "" {
+		return nil, errors.New("This invitation has already been used")
+	}
+
+	if exp, ok := parseGrantTime(invitation.Expires); ok && !time.Now().Before(exp) {
+		return nil, errors.New("This invitation has expired")
+	}
+
+	if !strings.EqualFold(invitation.Email, email) {
+		return nil, errors.New("This invitation was issued to a different email address")
+	}
+
+	return &invitation, nil
+}
+
+// UseInvitation marks the invitation as used so it can't be redeemed again
+func UseInvitation(backend *Backend, code string) error {
+	couch := NewCouch(backend.Couchdb, backend.Invitedb)
+	doc, err := couch.Get(code)
+
+	if err == nil {
+		doc["used"] = time.Now().UTC().Format(time.RFC3339)
+
+		var raw []byte
+		if raw, err = json.Marshal(doc); err == nil {
+			_, err = couch.Post(raw)
+		}
+	}
+
+	return err
+}
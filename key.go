@@ -1,18 +1,24 @@
 package gouncer
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
 )
 
 type KeyHandler struct {
 	Credentials
 	*ResponseHandler
 	*Backend
+	*KeyConfig
 }
 
 type KeyRequest struct {
@@ -21,12 +27,81 @@ type KeyRequest struct {
 }
 
 type KeyList struct {
-	ID    string
-	Pairs map[string]string
+	ID     string
+	Owner  string              // User the keys were issued to
+	Actor  string              // Admin the keys were issued to when impersonating the owner
+	Pairs  map[string]string   // Key -> system uri
+	Rights map[string][]string // Key -> rights granted by the key. Keys without an entry grant read
+}
+
+// KeyConfig holds the read key settings
+type KeyConfig struct {
+	Quota       int   // Requests allowed per key and quota period. 0 disables quotas
+	QuotaPeriod int32 // Quota period in seconds
+}
+
+// keyGrant is the outcome of a successful key validation
+type keyGrant struct {
+	KeyID       string
+	Owner       string
+	Actor       string
+	Rights      []string
+	Quota       int
+	QuotaPeriod int32
+}
+
+const (
+	keySeparator = "." // Separator between the key list ID and the key. URL safe and not part of the key alphabet
+	keyIDLength  = 32  // Key list IDs are hex encoded md5 sums
+)
+
+var (
+	errQuotaExceeded  = errors.New("Key quota exceeded. Please try again later.")
+	errMalformedKey   = errors.New("Key Error - Malformed key")
+	errKeyListMissing = errors.New("Cache Miss: Unable to retrieve keylist")
+	errUnknownKey     = errors.New("Key Error - Key does not appear in the key list.")
+	errKeySystem      = errors.New("Key not valid for system")
+	errKeyOwnerAccess = errors.New("The owner of this api key no longer has access to the system")
+)
+
+// keyErrorCodes maps validation errors onto the fixed codes stored in the audit log. Error
+// messages stay out of the audit log so they can never leak a key.
+var keyErrorCodes = map[error]string{
+	errQuotaExceeded:       "quota_exceeded",
+	errMalformedKey:        "malformed_key",
+	errKeyListMissing:      "unknown_key_list",
+	errUnknownKey:          "unknown_key",
+	errKeySystem:           "system_mismatch",
+	errKeyOwnerAccess:      "owner_access_revoked",
+	errApiKeyInvalid:       "invalid_api_key",
+	errApiKeyRevoked:       "api_key_revoked",
+	errApiKeyExpired:       "api_key_expired",
+	errApiKeyOwnerInactive: "owner_inactive",
+}
+
+// NewKeyList creates an empty key list with the provided ID
+func NewKeyList(id string) *KeyList {
+	return &KeyList{ID: id, Pairs: make(map[string]string), Rights: make(map[string][]string)}
+}
+
+// SplitKey splits a read key into the key list ID and the key. Besides the current separator it
+// accepts the legacy +, its form decoded space and percent encoded variants.
+func SplitKey(readKey string) (string, string, error) {
+	if unescaped, err := url.QueryUnescape(strings.Replace(readKey, "+", "%2B", -1)); err == nil {
+		readKey = unescaped
+	}
+
+	readKey = strings.TrimSpace(readKey)
+
+	if len(readKey) < keyIDLength+2 || !strings.ContainsRune(keySeparator+"+ ~:", rune(readKey[keyIDLength])) {
+		return "", "", errMalformedKey
+	}
+
+	return readKey[:keyIDLength], readKey[keyIDLength+1:], nil
 }
 
 func NewKeyHandler(h *ResponseHandler) *KeyHandler {
-	return &KeyHandler{ResponseHandler: h}
+	return &KeyHandler{ResponseHandler: h, KeyConfig: &KeyConfig{}}
 }
 
 func (k *KeyHandler) HandleRequest() {
@@ -42,50 +117,222 @@ func (k *KeyHandler) HandleRequest() {
 	}
 }
 
+// ValidateRequest checks the key against the system, enforces the key quota and audits the outcome
 func (k *KeyHandler) ValidateRequest(r *KeyRequest) {
+	var grant *keyGrant
+	var err error
+
+	if IsApiKey(r.Key) {
+		grant, err = k.apiKeyGrant(r)
+	} else {
+		grant, err = k.readKeyGrant(r)
+	}
+
+	if err == nil {
+		err = k.enforceQuota(grant)
+	}
+
+	k.audit(r, grant, err)
+
+	switch err {
+	case nil:
+		k.Response.Status = http.StatusOK
+		k.Response.AccessRights = grant.Rights
+	case errQuotaExceeded:
+		k.NewError(http.StatusTooManyRequests, err.Error())
+	default:
+		k.Logger.Println("KEY:", err)
+		k.NewError(http.StatusUnauthorized, err.Error())
+	}
+}
+
+// readKeyGrant validates an ephemeral key against the key list in the cache
+func (k *KeyHandler) readKeyGrant(r *KeyRequest) (*keyGrant, error) {
 	var kList KeyList
-	var id, key string
 
-	segs := strings.Split(r.Key, " ")
+	id, key, err := SplitKey(r.Key)
+
+	if err == nil {
+		var item *memcache.Item
+		item, err = k.CacheGet(KeyListCache, id)
+
+		if err != nil {
+			k.Logger.Println(err)
+		}
+
+		if item != nil && item.Value != nil && len(item.Value) > 0 {
+			err = json.Unmarshal(item.Value, &kList)
+		} else {
+			err = errKeyListMissing
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	grant := &keyGrant{KeyID: id + keySeparator + keyFingerprint(key), Owner: kList.Owner, Actor: kList.Actor, Quota: k.Quota, QuotaPeriod: k.QuotaPeriod}
+
+	if kList.Pairs[key] == "" {
+		return grant, errUnknownKey
+	}
+
+	if !k.systemMatch(kList.Pairs[key], r.System) {
+		return grant, errKeySystem
+	}
+
+	rights, exists := kList.Rights[key]
+	if !exists {
+		rights = []string{"read"}
+	}
+
+	grant.Rights = rights
+	return grant, nil
+}
 
-	if len(segs) == 2 {
-		id = segs[0]
-		key = segs[1]
+// apiKeyGrant validates a persistent api key and grants the rights stored on the key
+func (k *KeyHandler) apiKeyGrant(r *KeyRequest) (*keyGrant, error) {
+	apiKey, owner, err := ValidateApiKey(k.Backend, r.Key)
+
+	if apiKey == nil {
+		return nil, err
 	}
 
-	item, err := k.Cache.Get(id)
+	grant := &keyGrant{KeyID: apiKey.Id, Owner: apiKey.Owner, Rights: apiKey.Rights, Quota: k.Quota, QuotaPeriod: k.QuotaPeriod}
+
+	if apiKey.Quota > 0 {
+		grant.Quota = apiKey.Quota
+		grant.QuotaPeriod = apiKey.QuotaPeriod
+	}
 
 	if err != nil {
-		k.Logger.Println(err)
+		return grant, err
 	}
 
-	if item != nil && item.Value != nil && len(item.Value) > 0 {
-		err = json.Unmarshal(item.Value, &kList)
-	} else {
-		err = fmt.Errorf("Cache Miss: Unable to retrieve keylist")
+	for _, system := range apiKey.Systems {
+		if k.systemMatch(system, r.System) {
+			if !ApiKeyAccessible(k.Backend, apiKey, owner, r.System) {
+				return grant, errKeyOwnerAccess
+			}
+
+			return grant, nil
+		}
 	}
 
-	if kList.Pairs[key] == "" {
-		err = fmt.Errorf("Key Error - Key: %s does not appear in the key list.", key)
+	return grant, errKeySystem
+}
+
+// systemMatch checks if the key system (exact|wildcard) covers the requested system
+func (k *KeyHandler) systemMatch(keySystem string, system string) bool {
+	rSys, rerr := url.Parse(keySystem)
+	sys, serr := url.Parse(system)
+
+	return rerr == nil && serr == nil && rSys.Host == sys.Host && (k.ExactPathMatch(rSys.Path, sys.Path) || k.WildcardPathMatch(rSys.Path, sys.Path))
+}
+
+// enforceQuota counts the request against the quota of the key for the current period
+func (k *KeyHandler) enforceQuota(grant *keyGrant) error {
+	if grant.Quota <= 0 {
+		return nil
 	}
 
-	if err == nil {
-		rSys, _ := url.Parse(kList.Pairs[key])
-		sys, _ := url.Parse(r.System)
+	period := grant.QuotaPeriod
+	if period <= 0 {
+		period = 3600
+	}
 
-		if rSys.Host == sys.Host && k.ExactPathMatch(rSys.Path, sys.Path) || k.WildcardPathMatch(rSys.Path, sys.Path) {
-			k.Response.Status = http.StatusOK
-			k.Response.AccessRights = []string{"read"}
+	window := time.Now().Unix() / int64(period)
+	counter := k.CacheKey(QuotaCache, fmt.Sprintf("%s-%d", keyFingerprint(grant.KeyID), window))
 
-		} else {
-			k.NewError(http.StatusUnauthorized, "Key not valid for system")
+	count, err := k.Cache.Increment(counter, 1)
+
+	if err == memcache.ErrCacheMiss {
+		// First request in this period. Another request might beat us to it so retry the increment
+		if err = k.Cache.Add(&memcache.Item{Key: counter, Value: []byte("1"), Expiration: period}); err == nil {
+			count = 1
+		} else if err == memcache.ErrNotStored {
+			count, err = k.Cache.Increment(counter, 1)
 		}
 	}
 
 	if err != nil {
-		log.Println(err)
-		k.NewError(http.StatusUnauthorized, err.Error())
+		// Don't lock out keys when the cache misbehaves
+		k.Logger.Println("KEY QUOTA:", err)
+		return nil
+	}
+
+	if count > uint64(grant.Quota) {
+		return errQuotaExceeded
 	}
+
+	return nil
+}
+
+// audit records the key validation in the audit database
+func (k *KeyHandler) audit(r *KeyRequest, grant *keyGrant, err error) {
+	event := NewAuditEvent("key", k.HttpRequest)
+	event.System = r.System
+	event.Success = err == nil
+	event.KeyID = keyFingerprint(r.Key)
+
+	if grant != nil {
+		event.KeyID = grant.KeyID
+		event.Owner = grant.Owner
+
+		if grant.Actor != "" {
+			event.Actor = grant.Actor
+			event.ActingAs = grant.Owner
+		}
+	}
+
+	if err != nil {
+		event.Error = keyErrorCode(err)
+	}
+
+	k.Audit(event)
+}
+
+// HandleUsageRequest responds with the key audit events of the authenticated user.
+// An optional key query parameter limits the events to a single key.
+func (k *KeyHandler) HandleUsageRequest() {
+	err := k.ParseAuthHeader(k.HttpRequest.Header.Get("Authorization"))
+
+	if err == nil {
+		var valid bool
+		if valid, err = k.ValidCredentials(); valid {
+			selector := map[string]interface{}{"type": "key", "owner": k.Username}
+
+			if key := k.HttpRequest.URL.Query().Get("key"); key != "" {
+				selector["key_id"] = key
+			}
+
+			var events []AuditEvent
+			if events, err = k.AuditEvents(selector); err == nil {
+				k.Response.Status = http.StatusOK
+				k.Response.Events = events
+				return
+			}
+		} else if err == nil {
+			err = errors.New("Invalid credentials")
+		}
+	}
+
+	k.NewError(http.StatusUnauthorized, err.Error())
+}
+
+// keyErrorCode returns the audit code for a key validation error
+func keyErrorCode(err error) string {
+	if code, ok := keyErrorCodes[err]; ok {
+		return code
+	}
+
+	return "key_error"
+}
+
+// keyFingerprint identifies a key in logs and counters without revealing it
+func keyFingerprint(key string) string {
+	sum := sha1.Sum([]byte(key))
+	return hex.EncodeToString(sum[:])[:12]
 }
 
 // ExactPathMatch checks if the two paths are the same
@@ -11,12 +11,14 @@ import (
 	"os/exec"
 	"regexp"
 	"strings"
+	"time"
 )
 
 const (
 	linkPattern = "{{link}}"
 	codePattern = "{{code}}"
 	userPattern = "{{user}}"
+	datePattern = "{{date}}"
 )
 
 type Mail struct {
@@ -28,15 +30,31 @@ type Mail struct {
 }
 
 type MailConfig struct {
-	Sender           string   // Email address the messages are sent from
-	LinkTimeout      int32    // Time confirmation and cancellation links stay active
-	ConfirmSubject   string   // Confirmation mail subject field
-	ConfirmMessage   string   // Confirmation mail content body
-	CancelSubject    string   // Cancellation mail subject field
-	CancelMessage    string   // Cancellation mail content body
-	OneTimeSubject   string   // OneTime login mail subject
-	OneTimeMessage   string   // OneTime login mail content body
-	WhitelistDomains []string // Whitelisted domains that are allowed to handle confirmation and cancellation messages
+	Sender              string   // Email address the messages are sent from
+	LinkTimeout         int32    // Time confirmation and cancellation links stay active
+	ConfirmSubject      string   // Confirmation mail subject field
+	ConfirmMessage      string   // Confirmation mail content body
+	CancelSubject       string   // Cancellation mail subject field
+	CancelMessage       string   // Cancellation mail content body
+	OneTimeSubject      string   // OneTime login mail subject
+	OneTimeMessage      string   // OneTime login mail content body
+	InviteSubject       string   // Invitation mail subject
+	InviteMessage       string   // Invitation mail content body
+	ApprovedSubject     string   // Account approval mail subject
+	ApprovedMessage     string   // Account approval mail content body
+	RejectedSubject     string   // Account rejection mail subject
+	RejectedMessage     string   // Account rejection mail content body
+	EmailSubject        string   // Email change confirmation mail subject
+	EmailMessage        string   // Email change confirmation mail content body
+	EmailChangedSubject string   // Email change notification mail subject
+	EmailChangedMessage string   // Email change notification mail content body
+	ResetSubject        string   // Password reset mail subject
+	ResetMessage        string   // Password reset mail content body
+	PasswordSubject     string   // Password change notification mail subject
+	PasswordMessage     string   // Password change notification mail content body
+	RestoreSubject      string   // Account cancellation mail subject
+	RestoreMessage      string   // Account cancellation mail content body
+	WhitelistDomains    []string // Whitelisted domains that are allowed to handle confirmation and cancellation messages
 }
 
 func NewMailClient(recipient string, linkID string) *Mail {
@@ -117,6 +135,179 @@ func (m *Mail) OneTimePassword(pwd string, link string) error {
 	return m.sendMail(message)
 }
 
+func (m *Mail) Invitation(link string, inviter string) error {
+	// If a link is provided check if it is on the white list
+	if link != "" && !m.allowedDomain(link) {
+		return errors.New("Invitation link does not appear to be on the whitelist.")
+	}
+
+	var message string
+	rxp := regexp.MustCompile(linkPattern)
+	rxp2 := regexp.MustCompile(codePattern)
+	rxp3 := regexp.MustCompile(userPattern)
+
+	if m.InviteMessage != "" {
+		message = "Subject:" + m.InviteSubject + "\r\n\r\n"
+		message += rxp.ReplaceAllString(m.InviteMessage, link)
+		message = rxp2.ReplaceAllString(message, m.LinkID)
+		message = rxp3.ReplaceAllString(message, inviter)
+	} else {
+		message = "Subject:Account Invitation\r\n\r\n"
+		message += inviter + " invited you to create an account.\r\n"
+		message += "Use the following invitation code when registering: " + m.LinkID + "\r\n"
+		if link != "" {
+			message += rxp2.ReplaceAllString(link, m.LinkID) + "\r\n"
+		}
+		message += "Please ignore this message if you do not wish to create an account."
+	}
+
+	return m.sendMail(message)
+}
+
+// ApprovalRequest notifies an approver about an account awaiting approval
+func (m *Mail) ApprovalRequest(applicant string) error {
+	message := "Subject:Account awaiting approval\r\n\r\n"
+	message += "A new account for " + applicant + " is awaiting your approval.\r\n"
+	message += "Pending accounts can be approved or rejected through the /approvals endpoint."
+
+	return m.sendMail(message)
+}
+
+// ApprovalOutcome tells the applicant if their account was approved or rejected
+func (m *Mail) ApprovalOutcome(approved bool) error {
+	var message string
+	rxp := regexp.MustCompile(userPattern)
+
+	switch {
+	case approved && m.ApprovedMessage != "":
+		message = "Subject:" + m.ApprovedSubject + "\r\n\r\n"
+		message += rxp.ReplaceAllString(m.ApprovedMessage, m.Recipient)
+	case approved:
+		message = "Subject:Account approved\r\n\r\n"
+		message += "Your account (" + m.Recipient + ") has been approved. You can now login."
+	case m.RejectedMessage != "":
+		message = "Subject:" + m.RejectedSubject + "\r\n\r\n"
+		message += rxp.ReplaceAllString(m.RejectedMessage, m.Recipient)
+	default:
+		message = "Subject:Account rejected\r\n\r\n"
+		message += "Your registration for " + m.Recipient + " has been rejected. Please contact the administrator for more info."
+	}
+
+	return m.sendMail(message)
+}
+
+// EmailChange mails the confirmation code for an email address change to the new address
+func (m *Mail) EmailChange(link string) error {
+	// If a link is provided check if it is on the white list
+	if link != "" && !m.allowedDomain(link) {
+		return errors.New("Confirmation link does not appear on the whitelist")
+	}
+
+	var message string
+	rxp := regexp.MustCompile(linkPattern)
+	rxp2 := regexp.MustCompile(codePattern)
+
+	if m.EmailMessage != "" {
+		message = "Subject:" + m.EmailSubject + "\r\n\r\n"
+		message += rxp.ReplaceAllString(m.EmailMessage, link)
+		message = rxp2.ReplaceAllString(message, m.LinkID)
+	} else {
+		message = "Subject:Email address change\r\n\r\n"
+		message += "To complete the change of your account email address to " + m.Recipient + " use the following code: " + m.LinkID + "\r\n"
+		if link != "" {
+			message += link + "/" + m.LinkID + "\r\n"
+		}
+		message += "Please ignore this message if you did not request this change."
+	}
+
+	return m.sendMail(message)
+}
+
+// EmailChanged notifies the old address that the account moved to a new address
+func (m *Mail) EmailChanged(email string) error {
+	var message string
+	rxp := regexp.MustCompile(userPattern)
+
+	if m.EmailChangedMessage != "" {
+		message = "Subject:" + m.EmailChangedSubject + "\r\n\r\n"
+		message += rxp.ReplaceAllString(m.EmailChangedMessage, email)
+	} else {
+		message = "Subject:Email address changed\r\n\r\n"
+		message += "The email address of your account was changed to " + email + ".\r\n"
+		message += "Please contact the administrator immediately if you did not request this change."
+	}
+
+	return m.sendMail(message)
+}
+
+// PasswordReset mails the reset code for a forgotten password
+func (m *Mail) PasswordReset(link string) error {
+	var message string
+	rxp := regexp.MustCompile(linkPattern)
+	rxp2 := regexp.MustCompile(codePattern)
+	rxp3 := regexp.MustCompile(userPattern)
+
+	if m.ResetMessage != "" {
+		message = "Subject:" + m.ResetSubject + "\r\n\r\n"
+		message += rxp.ReplaceAllString(m.ResetMessage, link)
+		message = rxp2.ReplaceAllString(message, m.LinkID)
+		message = rxp3.ReplaceAllString(message, m.Recipient)
+	} else {
+		message = "Subject:Password reset\r\n\r\n"
+		message += "A password reset was requested for your account (" + m.Recipient + ").\r\n"
+		if link != "" {
+			message += "Use the following link to choose a new password: " + rxp2.ReplaceAllString(link, m.LinkID) + "\r\n"
+		} else {
+			message += "Use the following code to choose a new password: " + m.LinkID + "\r\n"
+		}
+		message += "Please ignore this message if you did not request a password reset."
+	}
+
+	return m.sendMail(message)
+}
+
+// PasswordChanged notifies the user that the account password was changed
+func (m *Mail) PasswordChanged() error {
+	var message string
+	rxp := regexp.MustCompile(userPattern)
+
+	if m.PasswordMessage != "" {
+		message = "Subject:" + m.PasswordSubject + "\r\n\r\n"
+		message += rxp.ReplaceAllString(m.PasswordMessage, m.Recipient)
+	} else {
+		message = "Subject:Password changed\r\n\r\n"
+		message += "The password of your account (" + m.Recipient + ") was changed and all sessions were logged out.\r\n"
+		message += "Please contact the administrator immediately if you did not make this change."
+	}
+
+	return m.sendMail(message)
+}
+
+// Restore tells the user when the cancelled account will be deleted and how to restore it
+func (m *Mail) Restore(deletion time.Time, link string) error {
+	var message string
+	rxp := regexp.MustCompile(linkPattern)
+	rxp2 := regexp.MustCompile(codePattern)
+	rxp3 := regexp.MustCompile(datePattern)
+
+	if m.RestoreMessage != "" {
+		message = "Subject:" + m.RestoreSubject + "\r\n\r\n"
+		message += rxp.ReplaceAllString(m.RestoreMessage, link)
+		message = rxp2.ReplaceAllString(message, m.LinkID)
+		message = rxp3.ReplaceAllString(message, deletion.Format("2006-01-02"))
+	} else {
+		message = "Subject:Account cancelled\r\n\r\n"
+		message += "Your account (" + m.Recipient + ") was cancelled and will be deleted on " + deletion.Format("2006-01-02") + ".\r\n"
+		if link != "" {
+			message += "Use the following link before then if you wish to restore your account: " + rxp2.ReplaceAllString(link, m.LinkID)
+		} else {
+			message += "Send in the following code before then if you wish to restore your account: " + m.LinkID
+		}
+	}
+
+	return m.sendMail(message)
+}
+
 // sendMail check the configured smtp mode to invoke the appropriate sendmail command
 func (m *Mail) sendMail(message string) error {
 	if m.Smtp == "sendmail" {
@@ -23,18 +23,40 @@ func InitGouncer() {
 	gouncer.Email = "ruben.dens@npolar.no"
 	gouncer.Flags = LoadFlags()
 	gouncer.Action = StartGouncerServer
+	gouncer.Commands = []cli.Command{
+		{
+			Name:   "migrate-users",
+			Usage:  "Convert user documents keyed by email address to stable user ids",
+			Action: MigrateUsers,
+		},
+	}
 	gouncer.Run(os.Args)
 }
 
 // @TODO define flags for CORS rules ?? Config file
 func LoadFlags() []cli.Flag {
 	return []cli.Flag{
+		cli.StringFlag{
+			Name:   "admin-system",
+			Usage:  "System uri on which the admin right grants gouncer administration",
+			EnvVar: "GOUNCER_ADMIN_SYSTEM",
+		},
 		cli.StringFlag{
 			Name:   "algorithm, a",
 			Value:  "HS256",
 			Usage:  "Specify token signing algorithm",
 			EnvVar: "GOUNCER_ALGORITHM",
 		},
+		cli.StringFlag{
+			Name:   "auditdb",
+			Usage:  "Set audit database. Audit events are logged when empty",
+			EnvVar: "GOUNCER_AUDIT_DB",
+		},
+		cli.StringFlag{
+			Name:   "cache-prefix",
+			Usage:  "Prefix for all cache keys. Use it to separate instances sharing a memcache cluster (max 128 of [A-Za-z0-9-_.:])",
+			EnvVar: "GOUNCER_CACHE_PREFIX",
+		},
 		cli.StringFlag{
 			Name:   "certificate, c",
 			Usage:  "Specify ssl certificate. [REQUIRED]",
@@ -51,6 +73,15 @@ func LoadFlags() []cli.Flag {
 			Usage:  "Specify CouchDB address",
 			EnvVar: "GOUNCER_COUCHDB",
 		},
+		cli.IntFlag{
+			Name:   "compact",
+			Usage:  "Store token systems server side when a user has more systems than this. 0 disables",
+			EnvVar: "GOUNCER_COMPACT_SYSTEMS",
+		},
+		cli.BoolFlag{
+			Name:  "debug",
+			Usage: "Enable debug features such as authorization explain traces",
+		},
 		cli.IntFlag{
 			Name:   "expiration, e",
 			Value:  1200,
@@ -68,15 +99,31 @@ func LoadFlags() []cli.Flag {
 			Usage:  "Set the servers hostname. Used when building confirmation uri's",
 			EnvVar: "GOUNCER_HOSTNAME",
 		},
+		cli.IntFlag{
+			Name:   "impersonation-expiration",
+			Value:  900,
+			Usage:  "Lifetime of admin impersonation tokens in seconds.",
+			EnvVar: "GOUNCER_IMPERSONATION_EXPIRE",
+		},
 		cli.BoolFlag{
 			Name:  "jsonp, j",
 			Usage: "Enable JsonP support",
 		},
+		cli.StringFlag{
+			Name:   "invitedb",
+			Usage:  "Set invitation database. Invitations are disabled when empty",
+			EnvVar: "GOUNCER_INVITE_DB",
+		},
 		cli.StringFlag{
 			Name:   "key, k",
 			Usage:  "Specify ssl certificate-key. [REQUIRED]",
 			EnvVar: "GOUNCER_SSL_KEY",
 		},
+		cli.StringFlag{
+			Name:   "keydb",
+			Usage:  "Set api key database. Api keys are disabled when empty",
+			EnvVar: "GOUNCER_KEY_DB",
+		},
 		cli.StringFlag{
 			Name:  "log, l",
 			Usage: "Log to specified file instead of STDOUT.",
@@ -92,6 +139,16 @@ func LoadFlags() []cli.Flag {
 			Value: "8950",
 			Usage: "Server port.",
 		},
+		cli.IntFlag{
+			Name:   "signed-url-max-age",
+			Usage:  "Maximum lifetime of signed urls in seconds. 0 means no limit",
+			EnvVar: "GOUNCER_SIGNED_URL_MAX_AGE",
+		},
+		cli.StringFlag{
+			Name:   "signing-secret",
+			Usage:  "Secret used to sign urls. Signed urls are disabled when empty",
+			EnvVar: "GOUNCER_SIGNING_SECRET",
+		},
 		cli.StringFlag{
 			Name:   "smtp, s",
 			Usage:  "Set SMTP server to use for notification mails",
@@ -130,6 +187,33 @@ func StartGouncerServer(c *cli.Context) {
 	srv.Start()
 }
 
+// MigrateUsers installs the user views and moves user documents that still use the email
+// address as id to opaque user ids. The backend is configured through the config file or flags.
+func MigrateUsers(c *cli.Context) {
+	backend := &gouncer.Backend{
+		Couchdb: c.GlobalString("couchdb"),
+		Userdb:  c.GlobalString("userdb"),
+	}
+
+	if cfg := c.GlobalString("config"); cfg != "" {
+		backend = ServerFromConf(cfg).Backend
+	}
+
+	backend.Logger = log.New(os.Stdout, "", log.Ldate|log.Ltime)
+
+	if err := gouncer.EnsureUserViews(backend); err != nil {
+		log.Fatalln("Error installing user views", err.Error())
+	}
+
+	migrated, err := gouncer.MigrateUserIDs(backend)
+
+	if err != nil {
+		log.Fatalln("Error migrating users", err.Error())
+	}
+
+	log.Println("Migrated", migrated, "user documents")
+}
+
 // ServerFromConf generates a server instance with the settings
 // specified in the specified config file. All other command line
 // arguments are igored in this operation mode
@@ -154,18 +238,22 @@ func ServerFromCli(c *cli.Context) *gouncer.Server {
 	CheckSSL(c)
 
 	// Initialize configuration components from cli
-	core := &gouncer.Core{c.String("hostname"), ":" + c.String("port"), c.Bool("jsonp"), c.String("log")}
+	core := &gouncer.Core{c.String("hostname"), ":" + c.String("port"), c.Bool("jsonp"), c.String("log"), c.Bool("debug"), c.String("admin-system")}
 	ssl := &gouncer.Ssl{c.String("certificate"), c.String("key")}
 
 	backend := &gouncer.Backend{
-		Couchdb:  c.String("couchdb"),
-		Userdb:   c.String("userdb"),
-		Groupdb:  c.String("groupdb"),
-		Memcache: c.StringSlice("memcache"),
-		Smtp:     c.String("smtp"),
+		Couchdb:     c.String("couchdb"),
+		Userdb:      c.String("userdb"),
+		Groupdb:     c.String("groupdb"),
+		Keydb:       c.String("keydb"),
+		Auditdb:     c.String("auditdb"),
+		Invitedb:    c.String("invitedb"),
+		Memcache:    c.StringSlice("memcache"),
+		CachePrefix: c.String("cache-prefix"),
+		Smtp:        c.String("smtp"),
 	}
 
-	token := &gouncer.Token{c.String("algorithm"), int32(c.Int("expiration"))}
+	token := &gouncer.Token{c.String("algorithm"), int32(c.Int("expiration")), c.Int("compact"), c.String("signing-secret"), int32(c.Int("signed-url-max-age")), int32(c.Int("impersonation-expiration"))}
 
 	// Create configuration
 	cfg := &gouncer.Config{
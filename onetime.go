@@ -49,7 +49,7 @@ func (o *OneTime) generateOneTimePassword(user string) (string, error) {
 
 		if err == nil {
 			pwd = o.GenerateHash(user + o.CharSalt(128) + o.TimeSalt())
-			err = o.CacheCredentials(user, []byte(pwd), 1800)
+			err = o.CacheCredentials(OneTimeCache, user, []byte(pwd), 1800)
 		} else {
 			err = errors.New("User Not found")
 		}
@@ -0,0 +1,56 @@
+package gouncer
+
+import (
+	"fmt"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	defaultMinPasswordLength = 8
+)
+
+// PasswordPolicy holds the requirements for new passwords
+type PasswordPolicy struct {
+	MinLength     int  // Minimum number of characters
+	MaxLength     int  // Maximum number of characters. 0 means no limit
+	RequireLetter bool // Passwords need at least one letter
+	RequireDigit  bool // Passwords need at least one digit
+}
+
+// CheckPassword validates a new password against the policy. A nil policy accepts any non empty password.
+func (p *PasswordPolicy) CheckPassword(pwd string) error {
+	if pwd == "" {
+		return fmt.Errorf("Password error: Missing password")
+	}
+
+	if p == nil {
+		return nil
+	}
+
+	length := utf8.RuneCountInString(pwd)
+
+	if length < p.MinLength {
+		return fmt.Errorf("Password error: Passwords need at least %d characters", p.MinLength)
+	}
+
+	if p.MaxLength > 0 && length > p.MaxLength {
+		return fmt.Errorf("Password error: Passwords can't be longer than %d characters", p.MaxLength)
+	}
+
+	var letter, digit bool
+	for _, r := range pwd {
+		letter = letter || unicode.IsLetter(r)
+		digit = digit || unicode.IsDigit(r)
+	}
+
+	if p.RequireLetter && !letter {
+		return fmt.Errorf("Password error: Passwords need at least one letter")
+	}
+
+	if p.RequireDigit && !digit {
+		return fmt.Errorf("Password error: Passwords need at least one digit")
+	}
+
+	return nil
+}
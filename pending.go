@@ -0,0 +1,214 @@
+package gouncer
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	defaultResendInterval = 60 // Seconds between confirmation mails for the same address
+	defaultResendLimit    = 5  // Confirmation mails that can be resent per registration
+)
+
+var errResendLimit = errors.New("Too many confirmation requests. Please try again later.")
+
+// PendingRegistration tracks the outstanding confirmation code for an email address. It lets
+// users request a new confirmation mail and makes duplicate registrations replace the old code.
+type PendingRegistration struct {
+	Email   string `json:"email"`
+	Code    string `json:"-"`
+	Link    string `json:"-"`
+	Created int64  `json:"created"`
+	Sent    int64  `json:"sent"`              // Last time a confirmation mail was sent
+	Expires int64  `json:"expires,omitempty"` // When the confirmation code stops working
+	Resends int    `json:"resends"`
+}
+
+// pendingEntry is the cached form of a pending registration
+type pendingEntry struct {
+	PendingRegistration
+	Code string `json:"code"`
+	Link string `json:"link,omitempty"`
+}
+
+// ResendRequest holds the address to resend the confirmation mail to
+type ResendRequest struct {
+	Email  string `json:"email"`
+	Link   string `json:"link,omitempty"`   // Defaults to the link used when registering
+	Rotate bool   `json:"rotate,omitempty"` // Issue a new code and invalidate the old one
+	Code   string `json:"code,omitempty"`   // Current confirmation code. Required to rotate it
+}
+
+// FetchPendingRegistration looks up the pending registration for the email address
+func FetchPendingRegistration(backend *Backend, email string) (*PendingRegistration, error) {
+	var entry pendingEntry
+
+	item, err := backend.CacheGet(PendingCache, strings.ToLower(email))
+
+	if err == nil {
+		err = json.Unmarshal(item.Value, &entry)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	pending := entry.PendingRegistration
+	pending.Code = entry.Code
+	pending.Link = entry.Link
+
+	return &pending, nil
+}
+
+// ClearPendingRegistration removes the pending registration index for the email address
+func ClearPendingRegistration(backend *Backend, email string) {
+	backend.CacheDelete(PendingCache, strings.ToLower(email))
+}
+
+// store caches the pending registration for as long as the confirmation code lives
+func (p *PendingRegistration) store(creds *Credentials, exp int32) error {
+	data, err := json.Marshal(&pendingEntry{PendingRegistration: *p, Code: p.Code, Link: p.Link})
+
+	if err == nil {
+		err = creds.CacheCredentials(PendingCache, strings.ToLower(p.Email), data, exp)
+	}
+
+	return err
+}
+
+// resendAllowed enforces the minimum interval and the maximum number of confirmation mails
+func (r *Register) resendAllowed(pending *PendingRegistration) error {
+	interval := r.ResendInterval
+	if interval <= 0 {
+		interval = defaultResendInterval
+	}
+
+	limit := r.ResendLimit
+	if limit <= 0 {
+		limit = defaultResendLimit
+	}
+
+	if wait := pending.Sent + int64(interval) - time.Now().Unix(); wait > 0 {
+		return fmt.Errorf("Please wait %d seconds before requesting another confirmation email", wait)
+	}
+
+	if pending.Resends >= limit {
+		return errResendLimit
+	}
+
+	return nil
+}
+
+// trackPending records the confirmation code for the address. An older code for the same
+// address is invalidated so there is only ever one pending registration per address.
+func (r *Register) trackPending(code string, previous *PendingRegistration) error {
+	now := time.Now().Unix()
+	pending := &PendingRegistration{Email: r.RegistrationInfo.Email, Code: code, Link: r.RegLink, Created: now, Sent: now}
+
+	if previous != nil {
+		if previous.Code != code {
+			r.CacheDelete(RegistrationCache, previous.Code)
+		}
+
+		pending.Created = previous.Created
+		pending.Resends = previous.Resends + 1
+	}
+
+	if r.LinkTimeout > 0 {
+		pending.Expires = now + int64(r.LinkTimeout)
+	}
+
+	return pending.store(&r.Credentials, r.LinkTimeout)
+}
+
+// Resend mails the confirmation code for a pending registration again. With rotate set
+// a new code is issued and the old one stops working. Only callers holding the current
+// code can rotate it, so nobody can invalidate the code of someone else's registration.
+func (r *Register) Resend() {
+	var req ResendRequest
+
+	if err := DecodeJsonRequest(r.HttpRequest.Body, &req); err != nil {
+		r.NewError(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	email := strings.ToLower(strings.TrimSpace(req.Email))
+	pending, err := FetchPendingRegistration(r.Backend, email)
+
+	if err != nil {
+		r.NewError(http.StatusNotFound, "No pending registration for: "+email)
+		return
+	}
+
+	if req.Rotate && subtle.ConstantTimeCompare([]byte(req.Code), []byte(pending.Code)) != 1 {
+		r.NewError(http.StatusForbidden, "Rotating the confirmation code requires the current code")
+		return
+	}
+
+	if err = r.resendAllowed(pending); err != nil {
+		r.NewError(http.StatusTooManyRequests, err.Error())
+		return
+	}
+
+	item, err := r.CacheGet(RegistrationCache, pending.Code)
+
+	if err != nil {
+		ClearPendingRegistration(r.Backend, email)
+		r.NewError(http.StatusGone, "The registration has expired. Please register again.")
+		return
+	}
+
+	code := pending.Code
+
+	if req.Rotate {
+		code = randomHex(20)
+	}
+
+	// Store the registration under the (new) code with a fresh timeout
+	if err = r.CacheCredentials(RegistrationCache, code, item.Value, r.LinkTimeout); err == nil {
+		r.RegistrationInfo.Email = email
+		r.RegLink = pending.Link
+
+		if req.Link != "" {
+			r.RegLink = req.Link
+		}
+
+		if err = r.trackPending(code, pending); err == nil {
+			mail := NewMailClient(email, code)
+			mail.MailConfig = r.MailConfig
+			mail.Backend = r.Backend
+			mail.Core = r.Core
+
+			err = mail.Confirmation(r.RegLink)
+		}
+	}
+
+	if err != nil {
+		r.NewError(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	r.NewResponse(http.StatusOK, "In a few moments you will receive a new confirmation email at: "+email+". Use the code inside to complete the registration.")
+}
+
+// Status responds with the state of the pending registration for the email query parameter.
+// The current confirmation code is required as well, so unknown addresses and wrong codes get
+// the same response and the endpoint can't be used to probe for pending registrations.
+func (r *Register) Status() {
+	query := r.HttpRequest.URL.Query()
+	email := strings.ToLower(strings.TrimSpace(query.Get("email")))
+	pending, err := FetchPendingRegistration(r.Backend, email)
+
+	if err != nil || subtle.ConstantTimeCompare([]byte(query.Get("code")), []byte(pending.Code)) != 1 {
+		r.NewError(http.StatusNotFound, "No pending registration for: "+email)
+		return
+	}
+
+	r.Response.Status = http.StatusOK
+	r.Response.Registration = pending
+}
@@ -0,0 +1,610 @@
+package gouncer
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxPolicyLength   = 1024 // Longest policy expression we are willing to compile
+	maxCachedPolicies = 1024 // Compiled policies kept in memory before the cache is reset
+)
+
+// policyCache holds compiled policies keyed by expression. Policies are edited at runtime, so
+// the cache is reset when it fills up instead of growing with every expression ever seen.
+var policyCache = struct {
+	sync.Mutex
+	entries map[string]*Policy
+}{entries: make(map[string]*Policy)}
+
+// hiddenUserFields are never exposed to policy expressions
+var hiddenUserFields = map[string]bool{"password": true, "salt": true, "hash": true}
+
+// PolicyContext holds the request attributes a policy is evaluated against
+type PolicyContext struct {
+	Time time.Time // Time attributes are always evaluated in UTC
+	IP   net.IP
+	User map[string]interface{}
+}
+
+// Policy is a compiled policy expression. The expression language supports
+//
+//	literals:    "text", 'text', 42, 1.5, true, false, null, ["a", "b"]
+//	attributes:  ip, time.hour, time.minute, time.weekday, time.date, time.unix (UTC), user.<field>
+//	comparison:  == != < <= > >=
+//	membership:  in (list membership or ip in cidr, eg. ip in "10.0.0.0/8")
+//	logic:       && || ! and parentheses
+//
+// Expressions can't loop or call out of the evaluator which keeps them safe to run on every request.
+type Policy struct {
+	Expression string
+	root       policyNode
+}
+
+// CompilePolicy parses a policy expression. Compiled policies are cached by expression.
+func CompilePolicy(expr string) (*Policy, error) {
+	policyCache.Lock()
+	p, cached := policyCache.entries[expr]
+	policyCache.Unlock()
+
+	if cached {
+		return p, nil
+	}
+
+	if len(expr) > maxPolicyLength {
+		return nil, fmt.Errorf("Policy error: expression exceeds %d characters", maxPolicyLength)
+	}
+
+	tokens, err := lexPolicy(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	parser := &policyParser{tokens: tokens}
+	root, err := parser.parseOr()
+
+	if err == nil && parser.peek().kind != tokEOF {
+		err = fmt.Errorf("Policy error: unexpected %q", parser.peek().text)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	p = &Policy{Expression: expr, root: root}
+
+	policyCache.Lock()
+	if len(policyCache.entries) >= maxCachedPolicies {
+		policyCache.entries = make(map[string]*Policy)
+	}
+	policyCache.entries[expr] = p
+	policyCache.Unlock()
+
+	return p, nil
+}
+
+// Evaluate runs the policy against the context. Policies have to evaluate to a boolean.
+func (p *Policy) Evaluate(ctx *PolicyContext) (bool, error) {
+	v, err := p.root.eval(ctx)
+
+	if err != nil {
+		return false, err
+	}
+
+	if b, ok := v.(bool); ok {
+		return b, nil
+	}
+
+	return false, errors.New("Policy error: expression does not evaluate to a boolean")
+}
+
+// EvaluatePolicy compiles and evaluates a policy expression in a single step
+func EvaluatePolicy(expr string, ctx *PolicyContext) (bool, error) {
+	p, err := CompilePolicy(expr)
+
+	if err != nil {
+		return false, err
+	}
+
+	return p.Evaluate(ctx)
+}
+
+// Attribute resolves an attribute path (eg. time.hour or user.affiliation) in the context
+func (ctx *PolicyContext) Attribute(path string) (interface{}, error) {
+	segs := strings.Split(path, ".")
+
+	switch segs[0] {
+	case "ip":
+		if len(segs) == 1 {
+			if ctx.IP == nil {
+				return nil, nil
+			}
+			return ctx.IP.String(), nil
+		}
+	case "time":
+		if len(segs) == 2 {
+			now := ctx.Time.UTC()
+
+			switch segs[1] {
+			case "hour":
+				return float64(now.Hour()), nil
+			case "minute":
+				return float64(now.Minute()), nil
+			case "weekday":
+				return strings.ToLower(now.Weekday().String()[:3]), nil
+			case "date":
+				return now.Format("2006-01-02"), nil
+			case "unix":
+				return float64(now.Unix()), nil
+			}
+		}
+	case "user":
+		if len(segs) > 1 && !hiddenUserFields[segs[1]] {
+			var v interface{} = ctx.User
+
+			for _, seg := range segs[1:] {
+				obj, ok := v.(map[string]interface{})
+				if !ok {
+					return nil, nil
+				}
+				v = obj[seg]
+			}
+
+			return v, nil
+		}
+
+		return nil, nil
+	}
+
+	return nil, fmt.Errorf("Policy error: unknown attribute %q", path)
+}
+
+// policyAttribute checks if the path names an attribute the context can resolve
+func policyAttribute(path string) bool {
+	segs := strings.Split(path, ".")
+
+	switch segs[0] {
+	case "ip":
+		return len(segs) == 1
+	case "time":
+		return len(segs) == 2 && strings.Contains(" hour minute weekday date unix ", " "+segs[1]+" ")
+	case "user":
+		return len(segs) > 1 && segs[1] != ""
+	}
+
+	return false
+}
+
+// Lexer
+
+type policyTokenKind int
+
+const (
+	tokEOF policyTokenKind = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokOp
+)
+
+type policyToken struct {
+	kind policyTokenKind
+	text string
+}
+
+func lexPolicy(expr string) ([]policyToken, error) {
+	var tokens []policyToken
+
+	for i := 0; i < len(expr); {
+		c := expr[i]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"' || c == '\'':
+			var sb strings.Builder
+			j := i + 1
+
+			for ; j < len(expr) && expr[j] != c; j++ {
+				if expr[j] == '\\' && j+1 < len(expr) {
+					j++
+				}
+				sb.WriteByte(expr[j])
+			}
+
+			if j >= len(expr) {
+				return nil, errors.New("Policy error: unterminated string")
+			}
+
+			tokens = append(tokens, policyToken{tokString, sb.String()})
+			i = j + 1
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(expr) && (expr[j] >= '0' && expr[j] <= '9' || expr[j] == '.') {
+				j++
+			}
+
+			tokens = append(tokens, policyToken{tokNumber, expr[i:j]})
+			i = j
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			j := i
+			for j < len(expr) && (expr[j] == '_' || expr[j] == '.' || expr[j] >= 'a' && expr[j] <= 'z' || expr[j] >= 'A' && expr[j] <= 'Z' || expr[j] >= '0' && expr[j] <= '9') {
+				j++
+			}
+
+			tokens = append(tokens, policyToken{tokIdent, expr[i:j]})
+			i = j
+		default:
+			op := ""
+			for _, candidate := range []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "(", ")", "[", "]", ","} {
+				if strings.HasPrefix(expr[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+
+			if op == "" {
+				return nil, fmt.Errorf("Policy error: unexpected character %q", c)
+			}
+
+			tokens = append(tokens, policyToken{tokOp, op})
+			i += len(op)
+		}
+	}
+
+	return append(tokens, policyToken{kind: tokEOF}), nil
+}
+
+// Parser
+
+type policyParser struct {
+	tokens []policyToken
+	pos    int
+}
+
+func (p *policyParser) peek() policyToken {
+	return p.tokens[p.pos]
+}
+
+func (p *policyParser) next() policyToken {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *policyParser) accept(op string) bool {
+	if t := p.peek(); t.kind == tokOp && t.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *policyParser) parseOr() (policyNode, error) {
+	left, err := p.parseAnd()
+
+	for err == nil && p.accept("||") {
+		var right policyNode
+		if right, err = p.parseAnd(); err == nil {
+			left = &logicNode{op: "||", left: left, right: right}
+		}
+	}
+
+	return left, err
+}
+
+func (p *policyParser) parseAnd() (policyNode, error) {
+	left, err := p.parseNot()
+
+	for err == nil && p.accept("&&") {
+		var right policyNode
+		if right, err = p.parseNot(); err == nil {
+			left = &logicNode{op: "&&", left: left, right: right}
+		}
+	}
+
+	return left, err
+}
+
+func (p *policyParser) parseNot() (policyNode, error) {
+	if p.accept("!") {
+		operand, err := p.parseNot()
+		return &notNode{operand}, err
+	}
+
+	return p.parseComparison()
+}
+
+func (p *policyParser) parseComparison() (policyNode, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	t := p.peek()
+	if t.kind == tokOp && strings.Contains(" == != < <= > >= ", " "+t.text+" ") || t.kind == tokIdent && t.text == "in" {
+		p.next()
+		right, err := p.parsePrimary()
+		return &compareNode{op: t.text, left: left, right: right}, err
+	}
+
+	return left, nil
+}
+
+func (p *policyParser) parsePrimary() (policyNode, error) {
+	t := p.next()
+
+	switch t.kind {
+	case tokString:
+		return &literalNode{t.text}, nil
+	case tokNumber:
+		n, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Policy error: invalid number %q", t.text)
+		}
+		return &literalNode{n}, nil
+	case tokIdent:
+		switch t.text {
+		case "true":
+			return &literalNode{true}, nil
+		case "false":
+			return &literalNode{false}, nil
+		case "null":
+			return &literalNode{nil}, nil
+		case "in":
+			return nil, errors.New("Policy error: unexpected in")
+		}
+
+		if !policyAttribute(t.text) {
+			return nil, fmt.Errorf("Policy error: unknown attribute %q", t.text)
+		}
+		return &attributeNode{t.text}, nil
+	case tokOp:
+		switch t.text {
+		case "(":
+			node, err := p.parseOr()
+			if err == nil && !p.accept(")") {
+				err = errors.New("Policy error: missing )")
+			}
+			return node, err
+		case "[":
+			list := &listNode{}
+			if p.accept("]") {
+				return list, nil
+			}
+			for {
+				item, err := p.parsePrimary()
+				if err != nil {
+					return nil, err
+				}
+				list.items = append(list.items, item)
+
+				if p.accept("]") {
+					return list, nil
+				}
+				if !p.accept(",") {
+					return nil, errors.New("Policy error: expected , or ] in list")
+				}
+			}
+		}
+	case tokEOF:
+		return nil, errors.New("Policy error: unexpected end of expression")
+	}
+
+	return nil, fmt.Errorf("Policy error: unexpected %q", t.text)
+}
+
+// Evaluation
+
+type policyNode interface {
+	eval(ctx *PolicyContext) (interface{}, error)
+}
+
+type literalNode struct{ value interface{} }
+
+type attributeNode struct{ path string }
+
+type listNode struct{ items []policyNode }
+
+type notNode struct{ operand policyNode }
+
+type logicNode struct {
+	op          string
+	left, right policyNode
+}
+
+type compareNode struct {
+	op          string
+	left, right policyNode
+}
+
+func (n *literalNode) eval(ctx *PolicyContext) (interface{}, error) {
+	return n.value, nil
+}
+
+func (n *attributeNode) eval(ctx *PolicyContext) (interface{}, error) {
+	v, err := ctx.Attribute(n.path)
+	return normalizePolicyValue(v), err
+}
+
+func (n *listNode) eval(ctx *PolicyContext) (interface{}, error) {
+	var list []interface{}
+
+	for _, item := range n.items {
+		v, err := item.eval(ctx)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+	}
+
+	return list, nil
+}
+
+func (n *notNode) eval(ctx *PolicyContext) (interface{}, error) {
+	v, err := n.operand.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if b, ok := v.(bool); ok {
+		return !b, nil
+	}
+
+	return nil, errors.New("Policy error: ! requires a boolean")
+}
+
+func (n *logicNode) eval(ctx *PolicyContext) (interface{}, error) {
+	l, err := n.left.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	lb, ok := l.(bool)
+	if !ok {
+		return nil, fmt.Errorf("Policy error: %s requires booleans", n.op)
+	}
+
+	// Short circuit
+	if n.op == "&&" && !lb || n.op == "||" && lb {
+		return lb, nil
+	}
+
+	r, err := n.right.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rb, ok := r.(bool)
+	if !ok {
+		return nil, fmt.Errorf("Policy error: %s requires booleans", n.op)
+	}
+
+	return rb, nil
+}
+
+func (n *compareNode) eval(ctx *PolicyContext) (interface{}, error) {
+	l, err := n.left.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := n.right.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "==":
+		return reflect.DeepEqual(l, r), nil
+	case "!=":
+		return !reflect.DeepEqual(l, r), nil
+	case "in":
+		return policyContains(l, r)
+	}
+
+	return policyOrder(n.op, l, r)
+}
+
+// policyContains checks list membership or if an ip lies within a cidr range
+func policyContains(item interface{}, container interface{}) (bool, error) {
+	switch c := container.(type) {
+	case []interface{}:
+		for _, candidate := range c {
+			if reflect.DeepEqual(item, candidate) {
+				return true, nil
+			}
+
+			if cidr, ok := candidate.(string); ok && strings.Contains(cidr, "/") {
+				if in, err := policyContains(item, cidr); err == nil && in {
+					return true, nil
+				}
+			}
+		}
+
+		return false, nil
+	case string:
+		_, network, err := net.ParseCIDR(c)
+		if err != nil {
+			return false, fmt.Errorf("Policy error: %q is not a list or cidr range", c)
+		}
+
+		ipStr, _ := item.(string)
+		ip := net.ParseIP(ipStr)
+
+		return ip != nil && network.Contains(ip), nil
+	case nil:
+		return false, nil
+	}
+
+	return false, errors.New("Policy error: in requires a list or cidr range")
+}
+
+// policyOrder handles the ordering comparisons for numbers and strings
+func policyOrder(op string, l interface{}, r interface{}) (bool, error) {
+	var cmp int
+
+	// Missing attributes never satisfy an ordering comparison
+	if l == nil || r == nil {
+		return false, nil
+	}
+
+	switch lv := l.(type) {
+	case float64:
+		rv, ok := r.(float64)
+		if !ok {
+			return false, fmt.Errorf("Policy error: can't compare number with %T", r)
+		}
+
+		switch {
+		case lv < rv:
+			cmp = -1
+		case lv > rv:
+			cmp = 1
+		}
+	case string:
+		rv, ok := r.(string)
+		if !ok {
+			return false, fmt.Errorf("Policy error: can't compare string with %T", r)
+		}
+
+		cmp = strings.Compare(lv, rv)
+	default:
+		return false, fmt.Errorf("Policy error: can't order %T", l)
+	}
+
+	switch op {
+	case "<":
+		return cmp < 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case ">":
+		return cmp > 0, nil
+	default:
+		return cmp >= 0, nil
+	}
+}
+
+// normalizePolicyValue converts go numeric types to float64 so they compare with number literals
+func normalizePolicyValue(v interface{}) interface{} {
+	switch n := v.(type) {
+	case int:
+		return float64(n)
+	case int32:
+		return float64(n)
+	case int64:
+		return float64(n)
+	case float32:
+		return float64(n)
+	}
+
+	return v
+}
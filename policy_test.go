@@ -0,0 +1,249 @@
+package gouncer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testPolicyContext() *PolicyContext {
+	return &PolicyContext{
+		Time: time.Date(2026, time.March, 4, 8, 30, 0, 0, time.UTC), // Wednesday
+		IP:   net.ParseIP("10.1.2.3"),
+		User: map[string]interface{}{
+			"email":       "user@example.com",
+			"affiliation": "npolar",
+			"level":       3.0,
+			"active":      true,
+			"password":    "secret",
+			"address":     map[string]interface{}{"country": "NO"},
+			"roles":       []interface{}{"editor"},
+		},
+	}
+}
+
+func TestLexPolicy(t *testing.T) {
+	tests := []struct {
+		expr   string
+		tokens []policyToken
+		err    bool
+	}{
+		{"", []policyToken{{tokEOF, ""}}, false},
+		{"time.hour >= 8", []policyToken{{tokIdent, "time.hour"}, {tokOp, ">="}, {tokNumber, "8"}, {tokEOF, ""}}, false},
+		{`ip in "10.0.0.0/8"`, []policyToken{{tokIdent, "ip"}, {tokIdent, "in"}, {tokString, "10.0.0.0/8"}, {tokEOF, ""}}, false},
+		{`'a\'b' != "c"`, []policyToken{{tokString, "a'b"}, {tokOp, "!="}, {tokString, "c"}, {tokEOF, ""}}, false},
+		{"!(a||b)&&c", []policyToken{{tokOp, "!"}, {tokOp, "("}, {tokIdent, "a"}, {tokOp, "||"}, {tokIdent, "b"}, {tokOp, ")"}, {tokOp, "&&"}, {tokIdent, "c"}, {tokEOF, ""}}, false},
+		{`["mon", 1.5]`, []policyToken{{tokOp, "["}, {tokString, "mon"}, {tokOp, ","}, {tokNumber, "1.5"}, {tokOp, "]"}, {tokEOF, ""}}, false},
+		{`"open`, nil, true},
+		{"a = b", nil, true},
+		{"a & b", nil, true},
+	}
+
+	for _, test := range tests {
+		tokens, err := lexPolicy(test.expr)
+
+		if (err != nil) != test.err {
+			t.Errorf("lexPolicy(%q) error = %v, want error %v", test.expr, err, test.err)
+			continue
+		}
+
+		if !test.err && !reflect.DeepEqual(tokens, test.tokens) {
+			t.Errorf("lexPolicy(%q) = %v, want %v", test.expr, tokens, test.tokens)
+		}
+	}
+}
+
+func TestCompilePolicyErrors(t *testing.T) {
+	tests := []string{
+		"",
+		"time.hour >=",
+		"(true",
+		"true)",
+		"true false",
+		"[1, 2",
+		"[1 2]",
+		"in",
+		"1..2 == 1",
+		"time.second == 1",
+		"time == 1",
+		"ip.addr == 1",
+		"user == 1",
+		"unknown == 1",
+		string(make([]byte, maxPolicyLength+1)),
+	}
+
+	for _, expr := range tests {
+		if _, err := CompilePolicy(expr); err == nil {
+			t.Errorf("CompilePolicy(%q) compiled, want error", expr)
+		}
+	}
+}
+
+func TestEvaluatePolicy(t *testing.T) {
+	tests := []struct {
+		name string
+		expr string
+		want bool
+	}{
+		// Literals and logic
+		{"true", "true", true},
+		{"not", "!false", true},
+		{"double not", "!!true", true},
+		{"and", "true && false", false},
+		{"or", "false || true", true},
+
+		// Precedence: ! binds tighter than &&, && tighter than ||
+		{"and before or", "true || false && false", true},
+		{"and before or left", "false && false || true", true},
+		{"parentheses", "(true || false) && false", false},
+		{"not before and", "!false && false", false},
+		{"not groups", "!(false || true)", false},
+		{"comparison before and", "1 < 2 && 2 < 3", true},
+
+		// Comparison
+		{"number equal", "1 == 1.0", true},
+		{"string order", `"a" < "b"`, true},
+		{"string not equal", `"a" != "b"`, true},
+		{"list membership", `"b" in ["a", "b"]`, true},
+		{"list miss", `"c" in ["a", "b"]`, false},
+		{"null equal", "user.missing == null", true},
+		{"missing attribute never orders", "user.missing > 1", false},
+		{"missing container", "1 in user.missing", false},
+
+		// CIDR
+		{"ip in cidr", `ip in "10.0.0.0/8"`, true},
+		{"ip outside cidr", `ip in "192.168.0.0/16"`, false},
+		{"ip host cidr", `ip in "10.1.2.3/32"`, true},
+		{"ip in cidr list", `ip in ["192.168.0.0/16", "10.1.0.0/16"]`, true},
+		{"ip equals", `ip == "10.1.2.3"`, true},
+		{"ipv6 outside ipv4 cidr", `"::1" in "10.0.0.0/8"`, false},
+		{"non ip in cidr", `"host" in "10.0.0.0/8"`, false},
+
+		// Time at 2026-03-04 08:30 UTC
+		{"hour lower bound", "time.hour >= 8", true},
+		{"hour before bound", "time.hour < 8", false},
+		{"hour upper bound", "time.hour < 16", true},
+		{"minute", "time.minute == 30", true},
+		{"weekday", `time.weekday == "wed"`, true},
+		{"weekday in", `time.weekday in ["mon", "tue", "wed", "thu", "fri"]`, true},
+		{"date", `time.date == "2026-03-04"`, true},
+		{"date range", `time.date >= "2026-03-01" && time.date < "2026-04-01"`, true},
+		{"unix", "time.unix == 1772613000", true},
+
+		// User fields
+		{"user string", `user.affiliation == "npolar"`, true},
+		{"user number", "user.level >= 3", true},
+		{"user bool", "user.active", true},
+		{"user nested", `user.address.country == "NO"`, true},
+		{"user list", `"editor" in user.roles`, true},
+		{"user hidden", "user.password == null", true},
+		{"user nested in scalar", "user.email.domain == null", true},
+	}
+
+	for _, test := range tests {
+		got, err := EvaluatePolicy(test.expr, testPolicyContext())
+
+		if err != nil {
+			t.Errorf("%s: EvaluatePolicy(%q) error: %v", test.name, test.expr, err)
+		} else if got != test.want {
+			t.Errorf("%s: EvaluatePolicy(%q) = %v, want %v", test.name, test.expr, got, test.want)
+		}
+	}
+}
+
+func TestEvaluatePolicyTimeBoundaries(t *testing.T) {
+	expr := `time.hour >= 8 && time.hour < 16 && time.weekday in ["mon", "tue", "wed", "thu", "fri"]`
+	oslo := time.FixedZone("CET", 3600)
+
+	tests := []struct {
+		name string
+		time time.Time
+		want bool
+	}{
+		{"last second before opening", time.Date(2026, time.March, 4, 7, 59, 59, 0, time.UTC), false},
+		{"opening", time.Date(2026, time.March, 4, 8, 0, 0, 0, time.UTC), true},
+		{"last second before closing", time.Date(2026, time.March, 4, 15, 59, 59, 0, time.UTC), true},
+		{"closing", time.Date(2026, time.March, 4, 16, 0, 0, 0, time.UTC), false},
+		{"friday", time.Date(2026, time.March, 6, 12, 0, 0, 0, time.UTC), true},
+		{"saturday", time.Date(2026, time.March, 7, 12, 0, 0, 0, time.UTC), false},
+		{"local time is converted to utc", time.Date(2026, time.March, 4, 8, 30, 0, 0, oslo), false},
+		{"local weekday is converted to utc", time.Date(2026, time.March, 7, 0, 30, 0, 0, oslo), false},
+	}
+
+	for _, test := range tests {
+		ctx := testPolicyContext()
+		ctx.Time = test.time
+
+		if got, err := EvaluatePolicy(expr, ctx); err != nil || got != test.want {
+			t.Errorf("%s: got %v (%v), want %v", test.name, got, err, test.want)
+		}
+	}
+}
+
+func TestEvaluatePolicyErrorsDeny(t *testing.T) {
+	tests := []string{
+		"1",
+		`"text"`,
+		"user.affiliation",
+		"!1",
+		"1 && true",
+		"true && 1",
+		`1 < "a"`,
+		`"a" < 1`,
+		"true < false",
+		`ip in "not a cidr"`,
+		"ip in 1",
+	}
+
+	auth := &Authorizer{Credentials: Credentials{Backend: &Backend{Logger: log.New(ioutil.Discard, "", 0)}}}
+	auth.policyCtx = testPolicyContext()
+
+	for _, expr := range tests {
+		if got, err := EvaluatePolicy(expr, testPolicyContext()); err == nil || got {
+			t.Errorf("EvaluatePolicy(%q) = %v, %v, want false with an error", expr, got, err)
+		}
+
+		entry := map[string]interface{}{"uri": "https://example.com/*", "rights": []interface{}{"read"}, "policy": expr}
+		if allowed, _ := auth.PolicyAllows(entry); allowed {
+			t.Errorf("PolicyAllows with policy %q allowed access, want deny", expr)
+		}
+
+		if _, match := auth.MatchSystem("https://example.com/info", []interface{}{entry}); match {
+			t.Errorf("MatchSystem with policy %q matched, want deny", expr)
+		}
+	}
+}
+
+func TestEvaluatePolicyShortCircuit(t *testing.T) {
+	// The right hand side would fail to evaluate but is never reached
+	tests := []string{
+		"false && 1",
+		"true || 1",
+	}
+
+	for _, expr := range tests {
+		if _, err := EvaluatePolicy(expr, testPolicyContext()); err != nil {
+			t.Errorf("EvaluatePolicy(%q) error: %v", expr, err)
+		}
+	}
+}
+
+func TestCompilePolicyCacheBounded(t *testing.T) {
+	for i := 0; i <= maxCachedPolicies*2; i++ {
+		if _, err := CompilePolicy(fmt.Sprintf("time.unix > %d", i)); err != nil {
+			t.Fatalf("CompilePolicy error: %v", err)
+		}
+	}
+
+	policyCache.Lock()
+	size := len(policyCache.entries)
+	policyCache.Unlock()
+
+	if size > maxCachedPolicies {
+		t.Errorf("policy cache holds %d entries, want at most %d", size, maxCachedPolicies)
+	}
+}
@@ -0,0 +1,193 @@
+package gouncer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"unicode/utf8"
+)
+
+// reservedFields can't be part of the profile since gouncer manages them
+var reservedFields = map[string]bool{
+	"_id": true, "_rev": true, "email": true, "name": true, "password": true, "salt": true, "hash": true,
+	"active": true, "status": true, "groups": true, "systems": true, "invitation": true, "link": true,
+	"deletion_date": true, "restore_code": true,
+}
+
+// ProfileSchema maps profile field names to their definition
+type ProfileSchema map[string]ProfileField
+
+// ProfileField defines a single profile field
+type ProfileField struct {
+	Type      string        // string | number | integer | boolean. Defaults to string
+	Required  bool          // The field has to be present and non empty
+	MaxLength int           // Maximum length of string values. 0 means no limit
+	Enum      []interface{} // Allowed values
+}
+
+// Validate checks the submitted data against the schema and returns the profile fields. Fields
+// that aren't part of the schema are dropped. Required fields are satisfied by the data or, for
+// updates, by the existing user document.
+func (schema ProfileSchema) Validate(data map[string]interface{}, existing map[string]interface{}) (map[string]interface{}, error) {
+	profile := make(map[string]interface{})
+
+	var names []string
+	for name := range schema {
+		names = append(names, name)
+	}
+	sort.Strings(names) // Report errors in a stable order
+
+	for _, name := range names {
+		field := schema[name]
+
+		if reservedFields[name] {
+			continue
+		}
+
+		value, submitted := data[name]
+
+		if !submitted || value == nil || value == "" {
+			if field.Required && (submitted || existing[name] == nil || existing[name] == "") {
+				return nil, fmt.Errorf("Profile error: %s is required", name)
+			}
+			continue
+		}
+
+		if err := field.check(name, value); err != nil {
+			return nil, err
+		}
+
+		profile[name] = value
+	}
+
+	return profile, nil
+}
+
+func (field ProfileField) check(name string, value interface{}) error {
+	switch field.Type {
+	case "number":
+		if _, ok := value.(float64); !ok {
+			return fmt.Errorf("Profile error: %s has to be a number", name)
+		}
+	case "integer":
+		if n, ok := value.(float64); !ok || n != math.Trunc(n) {
+			return fmt.Errorf("Profile error: %s has to be an integer", name)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("Profile error: %s has to be a boolean", name)
+		}
+	default:
+		str, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("Profile error: %s has to be a string", name)
+		}
+
+		if field.MaxLength > 0 && utf8.RuneCountInString(str) > field.MaxLength {
+			return fmt.Errorf("Profile error: %s exceeds %d characters", name, field.MaxLength)
+		}
+	}
+
+	if len(field.Enum) > 0 {
+		for _, allowed := range field.Enum {
+			if allowed == value || fmt.Sprint(allowed) == fmt.Sprint(value) {
+				return nil
+			}
+		}
+
+		return fmt.Errorf("Profile error: %v is not an allowed value for %s", value, name)
+	}
+
+	return nil
+}
+
+// Profile lets users view and update the profile fields in their user document
+type Profile struct {
+	Credentials
+	*ResponseHandler
+	Schema ProfileSchema
+}
+
+func NewProfile(h *ResponseHandler) *Profile {
+	return &Profile{ResponseHandler: h}
+}
+
+// HandleRequest validates the credentials and responds with (GET) or updates (POST) the profile
+func (p *Profile) HandleRequest() {
+	err := p.ParseAuthHeader(p.HttpRequest.Header.Get("Authorization"))
+
+	if err == nil {
+		var valid bool
+		if valid, err = p.ValidCredentials(); valid {
+			if p.HttpRequest.Method == "POST" {
+				p.Update()
+			} else {
+				p.Show()
+			}
+			return
+		} else if err == nil {
+			err = errors.New("Invalid credentials")
+		}
+	}
+
+	p.NewError(http.StatusUnauthorized, err.Error())
+}
+
+// Show responds with the name, email and profile fields of the user
+func (p *Profile) Show() {
+	profile := map[string]interface{}{"email": p.Username, "name": p.UserInfo["name"]}
+
+	for name := range p.Schema {
+		if value, exists := p.UserInfo[name]; exists && !reservedFields[name] {
+			profile[name] = value
+		}
+	}
+
+	p.Response.Status = http.StatusOK
+	p.Response.Profile = profile
+}
+
+// Update validates the submitted fields against the schema and saves them to the user document
+func (p *Profile) Update() {
+	var data = make(map[string]interface{})
+
+	if err := DecodeJsonRequest(p.HttpRequest.Body, &data); err != nil {
+		p.NewError(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	profile, err := p.Schema.Validate(data, p.UserInfo)
+
+	if err != nil {
+		p.NewError(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	for name, value := range profile {
+		p.UserInfo[name] = value
+	}
+
+	// Allow clearing optional fields by sending null or an empty string
+	for name, field := range p.Schema {
+		if value, submitted := data[name]; submitted && (value == nil || value == "") && !field.Required && !reservedFields[name] {
+			delete(p.UserInfo, name)
+		}
+	}
+
+	doc, err := json.Marshal(p.UserInfo)
+
+	if err == nil {
+		couch := NewCouch(p.Couchdb, p.Userdb)
+		_, err = couch.Post(doc)
+	}
+
+	if err != nil {
+		p.NewError(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	p.Show()
+}
@@ -0,0 +1,160 @@
+package gouncer
+
+import (
+	"crypto"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+const (
+	resetCodeTimeout = 1800 // Lifetime of a reset code when no link timeout is configured
+)
+
+// PasswordRecovery lets users that forgot their password set a new one through a mailed reset code
+type PasswordRecovery struct {
+	Credentials
+	*ResponseHandler
+	*Core
+	*MailConfig
+	*PasswordPolicy
+}
+
+// RecoveryRequest asks for a reset code to be mailed to the address
+type RecoveryRequest struct {
+	Email string `json:"email"`
+	Link  string `json:"link,omitempty"` // Reset page. Use the {{code}} pattern to inject the code
+}
+
+// RecoveryConfirmation sets a new password with the mailed reset code
+type RecoveryConfirmation struct {
+	Code     string `json:"code"`
+	Password string `json:"password"`
+}
+
+func NewPasswordRecovery(h *ResponseHandler) *PasswordRecovery {
+	return &PasswordRecovery{ResponseHandler: h}
+}
+
+// Request mails a reset code to the address. The response is the same whether the account
+// exists or not so the endpoint can't be used to probe for accounts.
+func (p *PasswordRecovery) Request() {
+	var req RecoveryRequest
+
+	if err := DecodeJsonRequest(p.HttpRequest.Body, &req); err != nil {
+		p.NewError(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	p.Username = strings.ToLower(strings.TrimSpace(req.Email))
+
+	if p.Username == "" {
+		p.NewError(http.StatusBadRequest, "No email address provided")
+		return
+	}
+
+	if req.Link != "" && !p.allowedLink(req.Link) {
+		p.NewError(http.StatusBadRequest, "Reset link does not appear on the whitelist")
+		return
+	}
+
+	if _, err := p.FetchUser(); err == nil {
+		if err = p.SendResetCode(req.Link); err != nil {
+			p.Logger.Println("PASSWORD RESET:", err)
+		}
+	}
+
+	p.NewResponse(http.StatusOK, "If an account exists for "+p.Username+" you will receive an email with a reset code in a few moments.")
+}
+
+// SendResetCode caches a new reset code for the user and mails it
+func (p *PasswordRecovery) SendResetCode(link string) error {
+	code := randomHex(20)
+
+	err := p.CacheCredentials(ResetCache, code, []byte(p.Username), p.codeTimeout())
+
+	if err == nil {
+		mail := NewMailClient(p.Username, code)
+		mail.MailConfig = p.MailConfig
+		mail.Backend = p.Backend
+		mail.Core = p.Core
+
+		err = mail.PasswordReset(link)
+	}
+
+	return err
+}
+
+// Confirm sets the new password for the account the reset code was issued to. The code can only
+// be used once, all sessions of the user are invalidated and the user is notified.
+func (p *PasswordRecovery) Confirm() {
+	var conf RecoveryConfirmation
+
+	if err := DecodeJsonRequest(p.HttpRequest.Body, &conf); err != nil {
+		p.NewError(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := p.CheckPassword(conf.Password); err != nil {
+		p.NewError(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	item, err := p.CacheGet(ResetCache, conf.Code)
+
+	if err != nil || conf.Code == "" {
+		p.NewError(http.StatusUnauthorized, "Invalid or expired reset code")
+		return
+	}
+
+	p.Username = string(item.Value)
+	userInfo, err := p.FetchUser()
+
+	if err == nil {
+		p.HashAlg = crypto.SHA512
+		p.Password = conf.Password
+		p.Salt = p.CharSalt(64)
+
+		userInfo["hash"] = "sha512"
+		userInfo["salt"] = p.Salt
+		userInfo["password"] = p.PasswordHash()
+
+		var doc []byte
+		if doc, err = json.Marshal(userInfo); err == nil {
+			_, err = NewCouch(p.Couchdb, p.Userdb).Post(doc)
+		}
+	}
+
+	if err != nil {
+		p.NewError(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Burn the code and drop the sessions and read keys issued with the old password
+	p.CacheDelete(ResetCache, conf.Code)
+	p.RevokeSessions()
+
+	mail := NewMailClient(p.Username, "")
+	mail.MailConfig = p.MailConfig
+	mail.Backend = p.Backend
+	mail.Core = p.Core
+
+	if err = mail.PasswordChanged(); err != nil {
+		p.Logger.Println("PASSWORD RESET:", err)
+	}
+
+	p.NewResponse(http.StatusOK, "Your password was successfully updated. Please login with your new password.")
+}
+
+func (p *PasswordRecovery) allowedLink(link string) bool {
+	mail := &Mail{MailConfig: p.MailConfig}
+	return mail.allowedDomain(link)
+}
+
+func (p *PasswordRecovery) codeTimeout() int32 {
+	if p.LinkTimeout > 0 {
+		return p.LinkTimeout
+	}
+
+	return resetCodeTimeout
+}
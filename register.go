@@ -4,25 +4,37 @@ import (
 	"crypto"
 	"encoding/json"
 	"errors"
+	"io/ioutil"
 	"net/http"
-	"regexp"
 	"strings"
 )
 
 type Register struct {
 	*Core
 	*MailConfig
+	*RegistrationConfig
+	*PasswordPolicy
 	Credentials
 	*ResponseHandler
 	RegistrationInfo
-	Groups  map[string]Registration
-	RegLink string
+	Groups     map[string]Registration
+	Schema     ProfileSchema
+	RegLink    string
+	invitation *Invitation
+	rule       Registration
+	profile    map[string]interface{}
 }
 
 // Registration groups
 type Registration struct {
-	Domain string
-	Groups []string
+	Domain     string // Domain (npolar.no), wildcard (*.npolar.no), * or default
+	Subdomains bool   // Also match subdomains of Domain
+	Groups     []string
+	Priority   int      // Rules with a higher priority are evaluated first
+	Deny       bool     // Reject registrations from matching domains
+	Final      bool     // Don't evaluate lower priority rules when this rule matches
+	Approval   bool     // New accounts for the domain have to be approved before they become active
+	Approvers  []string // Email addresses notified about pending accounts. They can approve or reject them
 }
 
 type RegistrationInfo struct {
@@ -32,9 +44,11 @@ type RegistrationInfo struct {
 	Password string   `json:"password,omitempty"`
 	Link     string   `json:"link,omitempty"`
 	Salt     string   `json:"salt,omitempty"`
-	Active   bool     `json:"active,omitempty"`
+	Active   bool     `json:"active"`
+	Status   string   `json:"status,omitempty"` // pending while awaiting approval
 	Groups   []string `json:"groups,omitempty"`
 	Hash     string   `json:"hash,omitempty"`
+	Invite   string   `json:"invitation,omitempty"` // Invite code. Kept on the user document for reference
 }
 
 func NewRegistration(h *ResponseHandler) *Register {
@@ -43,11 +57,31 @@ func NewRegistration(h *ResponseHandler) *Register {
 
 // Submit triggers the registration sequence.
 func (r *Register) Submit() {
-	if err := DecodeJsonRequest(r.HttpRequest.Body, &r.RegistrationInfo); err == nil {
-		r.processRegistration()
-	} else {
+	raw, err := ioutil.ReadAll(r.HttpRequest.Body)
+	r.HttpRequest.Body.Close()
+
+	if err == nil {
+		err = json.Unmarshal(raw, &r.RegistrationInfo)
+	}
+
+	if err != nil {
 		r.NewError(http.StatusNotAcceptable, err.Error())
+		return
 	}
+
+	// The account status is decided by the server, never by the client
+	r.RegistrationInfo.Status = ""
+
+	// Everything besides the registration info is validated against the profile schema
+	var data = make(map[string]interface{})
+	json.Unmarshal(raw, &data)
+
+	if r.profile, err = r.Schema.Validate(data, nil); err != nil {
+		r.NewError(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	r.processRegistration()
 }
 
 // Cancel triggers the account cancellation sequence
@@ -76,16 +110,40 @@ func (r *Register) processRegistration() {
 		}
 	}
 
+	// Check the invitation (if applicable) before going any further
+	if err := r.resolveInvitation(); err != nil {
+		r.NewError(http.StatusForbidden, err.Error())
+		return
+	}
+
+	// Resolve the registration rules for the email domain
+	if err := r.resolveRegistration(); err != nil {
+		r.NewError(http.StatusForbidden, err.Error())
+		return
+	}
+
 	// Captcha validation succeeds, proceed with registration
-	couch := NewCouch(r.Backend.Couchdb, r.Backend.Userdb)
-	_, err := couch.Get(r.RegistrationInfo.Email)
+	exists, err := UserExists(r.Backend, r.RegistrationInfo.Email)
+
+	if !exists {
+		if err == nil {
+			// Registering again replaces the pending registration, so it's subject to the resend limits
+			pending, _ := FetchPendingRegistration(r.Backend, r.RegistrationInfo.Email)
+			if pending != nil {
+				if lerr := r.resendAllowed(pending); lerr != nil {
+					r.NewError(http.StatusTooManyRequests, lerr.Error())
+					return
+				}
+			}
 
-	if err != nil {
-		if err.Error() == "404 Object Not Found" {
 			r.RegLink = r.RegistrationInfo.Link
 			id, rerr := r.cacheRegistrationRequest()
 			err = rerr
 
+			if err == nil {
+				err = r.trackPending(id, pending)
+			}
+
 			if err == nil {
 				mail := NewMailClient(r.RegistrationInfo.Email, id)
 				mail.MailConfig = r.MailConfig
@@ -111,6 +169,11 @@ func (r *Register) processCancellation() {
 	var err error
 
 	if valid, cerr := r.ValidCredentials(); valid {
+		if r.Impersonated() {
+			r.NewError(http.StatusForbidden, errImpersonation.Error())
+			return
+		}
+
 		err = r.cancelAccount()
 	} else {
 		err = cerr
@@ -127,7 +190,7 @@ func (r *Register) cancelAccount() error {
 	r.Credentials.HashAlg = crypto.SHA1
 	id := r.Credentials.GenerateHash(r.Username + r.TimeSalt() + r.CharSalt(32))
 
-	if err = r.CacheCredentials(id, []byte(r.Username), r.LinkTimeout); err == nil {
+	if err = r.CacheCredentials(CancelCache, id, []byte(r.Username), r.LinkTimeout); err == nil {
 		mail := NewMailClient(r.Username, id)
 		mail.MailConfig = r.MailConfig
 		mail.Backend = r.Backend
@@ -154,6 +217,10 @@ func (r *Register) cacheRegistrationRequest() (string, error) {
 		return "", errors.New("[Registration Error] Missing password")
 	}
 
+	if err := r.CheckPassword(r.RegistrationInfo.Password); err != nil {
+		return "", err
+	}
+
 	// Lowercase the email address
 	r.RegistrationInfo.Email = strings.ToLower(r.RegistrationInfo.Email)
 
@@ -166,33 +233,90 @@ func (r *Register) cacheRegistrationRequest() (string, error) {
 	r.Credentials.HashAlg = crypto.SHA1
 	key := r.Credentials.GenerateHash(r.RegistrationInfo.Email + r.TimeSalt() + r.CharSalt(32))
 
-	r.RegistrationInfo.Id = r.RegistrationInfo.Email
+	r.RegistrationInfo.Id = NewUserID()
 	r.RegistrationInfo.Password = passhash
 	r.RegistrationInfo.Salt = r.Credentials.Salt
 	r.RegistrationInfo.Active = true
-	r.RegistrationInfo.Groups = r.defaultGroups()
+	r.RegistrationInfo.Groups = r.registrationGroups()
+
+	// Invited users were vetted by the inviter. Everybody else might need approval
+	if r.invitation == nil && r.rule.Approval {
+		r.RegistrationInfo.Active = false
+		r.RegistrationInfo.Status = pendingStatus
+	}
 	r.RegistrationInfo.Hash = "sha512"
 	r.RegistrationInfo.Link = "" // set a blank link string since we don't want this in the db
 
-	userDoc, _ := json.Marshal(r.RegistrationInfo)
+	userDoc, err := r.userDocument()
+	if err != nil {
+		return "", err
+	}
 
 	// Create a new cache entry for the registration request
-	err := r.CacheCredentials(key, userDoc, r.LinkTimeout)
+	err = r.CacheCredentials(RegistrationCache, key, userDoc, r.LinkTimeout)
 	return key, err
 }
 
-// defaultGroups tries to assing default group settings to users based on the email domain.
-func (r *Register) defaultGroups() []string {
-	mailregxp := regexp.MustCompile(".*@(.*\\.[a-zA-Z]{2,3})")
-	matches := mailregxp.FindStringSubmatch(r.RegistrationInfo.Email)
+// userDocument combines the registration info with the validated profile fields
+func (r *Register) userDocument() ([]byte, error) {
+	info, err := json.Marshal(r.RegistrationInfo)
+
+	if err != nil || len(r.profile) == 0 {
+		return info, err
+	}
+
+	var doc = make(map[string]interface{})
+	if err = json.Unmarshal(info, &doc); err != nil {
+		return nil, err
+	}
 
-	// Check if the users email domain matches any of the configured group domains
-	for _, grp := range r.Groups {
-		if grp.Domain == matches[1] {
-			return grp.Groups
+	for name, value := range r.profile {
+		doc[name] = value
+	}
+
+	return json.Marshal(doc)
+}
+
+// resolveInvitation loads the invitation referenced in the registration request. Without an
+// invitation the registration is only accepted when the server isn't running in invite only mode.
+func (r *Register) resolveInvitation() error {
+	if r.RegistrationInfo.Invite == "" {
+		if r.InviteOnly {
+			return errors.New("Registration requires an invitation")
 		}
+
+		return nil
+	}
+
+	invitation, err := FetchInvitation(r.Backend, r.RegistrationInfo.Invite, r.RegistrationInfo.Email)
+	r.invitation = invitation
+
+	return err
+}
+
+// registrationGroups returns the groups of the invitation or the default groups for the email domain
+func (r *Register) registrationGroups() []string {
+	if r.invitation != nil {
+		return r.invitation.Groups
+	}
+
+	return r.defaultGroups()
+}
+
+// resolveRegistration merges the registration rules for the email address. Invited users
+// bypass the domain rules since the inviter decided on their groups.
+func (r *Register) resolveRegistration() error {
+	if r.invitation != nil {
+		return nil
 	}
 
-	// If none of the group domains matched return the default group
-	return r.Groups["default"].Groups
+	rule, err := MatchRegistration(r.Groups, r.RegistrationInfo.Email)
+	r.rule = rule
+
+	return err
+}
+
+// defaultGroups tries to assing default group settings to users based on the email domain.
+func (r *Register) defaultGroups() []string {
+	return r.rule.Groups
 }
@@ -9,6 +9,7 @@ import (
 type Reset struct {
 	Credentials
 	*ResponseHandler
+	*PasswordPolicy
 }
 
 type ResetBody struct {
@@ -38,6 +39,11 @@ func (re *Reset) UserPassword() {
 
 func (re *Reset) handleReset(rb ResetBody) {
 	if rb.Password != "" {
+		if err := re.CheckPassword(rb.Password); err != nil {
+			re.NewError(http.StatusBadRequest, err.Error())
+			return
+		}
+
 		if re.Token == "" && re.Password != "" {
 			re.basicReset(rb)
 		} else {
@@ -58,6 +64,11 @@ func (re *Reset) basicReset(rb ResetBody) {
 
 func (re *Reset) tokenReset(rb ResetBody) {
 	if valid, err := re.ValidToken(); valid {
+		if re.Impersonated() {
+			re.NewError(http.StatusForbidden, errImpersonation.Error())
+			return
+		}
+
 		re.executeReset(rb)
 	} else {
 		re.NewError(http.StatusUnauthorized, err.Error())
@@ -22,7 +22,17 @@ type Response struct {
 	Error        string      `json:"error,omitempty" xml:"Error,omitempty"`
 	Message      string      `json:"message,omitempty" xml:"Message,omitempty"`
 	Token        string      `json:"token,omitempty" xml:"Token,omitempty"`
+	Url          string      `json:"url,omitempty" xml:"Url,omitempty"`
 	AccessRights interface{} `json:"rights,omitempty" xml:"Access>Right,omitempty"`
+	Systems      interface{} `json:"systems,omitempty" xml:"Systems>System,omitempty"`
+	Explain      interface{} `json:"explain,omitempty" xml:"Explain,omitempty"`
+	Keys         interface{} `json:"keys,omitempty" xml:"Keys>Key,omitempty"`
+	Events       interface{} `json:"events,omitempty" xml:"Events>Event,omitempty"`
+	Users        interface{} `json:"users,omitempty" xml:"Users>User,omitempty"`
+	Groups       interface{} `json:"groups,omitempty" xml:"Groups>Group,omitempty"`
+	Profile      interface{} `json:"profile,omitempty" xml:"-"`
+	Registration interface{} `json:"registration,omitempty" xml:"Registration,omitempty"`
+	Archive      interface{} `json:"archive,omitempty" xml:"-"`
 	Info         *Info       `json:"info,omitempty" xml:",omitempty"`
 }
 
@@ -67,8 +77,12 @@ func (h *ResponseHandler) RespondText() {
 	if h.Response.Error == "" {
 		if h.Response.Token != "" {
 			fmt.Fprintf(h.Writer, "%v", h.Response.Token)
+		} else if h.Response.Url != "" {
+			fmt.Fprintf(h.Writer, "%v", h.Response.Url)
 		} else if h.Response.AccessRights != nil {
 			fmt.Fprintf(h.Writer, "%v", h.Response.AccessRights)
+		} else if h.Response.Systems != nil {
+			fmt.Fprintf(h.Writer, "%v", h.Response.Systems)
 		} else {
 			fmt.Fprintf(h.Writer, "%+v", h.Response.Info)
 		}
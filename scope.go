@@ -0,0 +1,164 @@
+package gouncer
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+)
+
+// Scope limits a token to a subset of the systems and rights available to the user
+type Scope struct {
+	Systems []string `json:"systems,omitempty"` // Requested system uris. Wildcards are allowed
+	Rights  []string `json:"rights,omitempty"`  // Requested rights
+}
+
+// ParseScope reads the requested scope from the system and rights query parameters.
+// Rights can be repeated or comma separated. It returns nil when no scope was requested.
+func ParseScope(query url.Values) *Scope {
+	scope := &Scope{Systems: query["system"]}
+
+	for _, rights := range query["rights"] {
+		for _, right := range strings.Split(rights, ",") {
+			if right = strings.TrimSpace(right); right != "" {
+				scope.Rights = append(scope.Rights, right)
+			}
+		}
+	}
+
+	if len(scope.Systems) == 0 && len(scope.Rights) == 0 {
+		return nil
+	}
+
+	return scope
+}
+
+// ClaimScopes decodes the scopes stored in a token claim
+func ClaimScopes(claim interface{}) ([]*Scope, error) {
+	var scopes []*Scope
+
+	if claim == nil {
+		return scopes, nil
+	}
+
+	raw, err := json.Marshal(claim)
+
+	if err == nil {
+		err = json.Unmarshal(raw, &scopes)
+	}
+
+	return scopes, err
+}
+
+// Apply returns the intersection of the systems and the scope. Entries covering a requested
+// system are narrowed down to that system. Entries are copied so the input is left untouched.
+// Every uri appears once. Like duplicate systems elsewhere, a later entry overrides an earlier one.
+func (s *Scope) Apply(systems []interface{}) []interface{} {
+	var scoped []interface{}
+	index := make(map[string]int)
+
+	add := func(cp map[string]interface{}) {
+		uri := cp["uri"].(string)
+
+		if i, exists := index[uri]; exists {
+			scoped[i] = cp
+			return
+		}
+
+		index[uri] = len(scoped)
+		scoped = append(scoped, cp)
+	}
+
+	for _, sys := range systems {
+		entry, ok := sys.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		uri, _ := entry["uri"].(string)
+		rights := s.intersectRights(entry["rights"])
+
+		if len(rights) == 0 {
+			continue
+		}
+
+		if len(s.Systems) == 0 {
+			add(s.copyEntry(entry, uri, rights))
+			continue
+		}
+
+		for _, requested := range s.Systems {
+			switch {
+			case s.covers(uri, requested):
+				add(s.copyEntry(entry, requested, rights))
+			case s.covers(requested, uri):
+				add(s.copyEntry(entry, uri, rights))
+			}
+		}
+	}
+
+	return scoped
+}
+
+// covers checks if the system uri a grants access to everything under uri b
+func (s *Scope) covers(a string, b string) bool {
+	urlA, errA := url.Parse(a)
+	urlB, errB := url.Parse(b)
+
+	if errA != nil || errB != nil || urlA.Host != urlB.Host {
+		return false
+	}
+
+	if urlA.Path == urlB.Path {
+		return true
+	}
+
+	segsA := strings.Split(urlA.Path, "/")
+	segsB := strings.Split(urlB.Path, "/")
+
+	if segsA[len(segsA)-1] != "*" || len(segsB) < len(segsA) {
+		return false
+	}
+
+	for i, seg := range segsA[:len(segsA)-1] {
+		if segsB[i] != seg && seg != "*" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// intersectRights returns the rights present in both the entry and the scope
+func (s *Scope) intersectRights(entryRights interface{}) []interface{} {
+	var rights []interface{}
+
+	list, _ := entryRights.([]interface{})
+
+	for _, right := range list {
+		if len(s.Rights) == 0 {
+			rights = append(rights, right)
+			continue
+		}
+
+		for _, requested := range s.Rights {
+			if right == requested {
+				rights = append(rights, right)
+			}
+		}
+	}
+
+	return rights
+}
+
+func (s *Scope) copyEntry(entry map[string]interface{}, uri string, rights []interface{}) map[string]interface{} {
+	cp := make(map[string]interface{})
+
+	for k, v := range entry {
+		cp[k] = v
+	}
+
+	cp["uri"] = uri
+	cp["rights"] = rights
+
+	return cp
+}
@@ -5,6 +5,8 @@ import (
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/bradfitz/gomemcache/memcache"
 	"github.com/rs/cors"
@@ -23,14 +25,20 @@ type Config struct {
 	*Token
 	Registrations map[string]Registration
 	*MailConfig
+	*KeyConfig
+	*RegistrationConfig
+	*PasswordPolicy
+	Profile ProfileSchema
 }
 
 // Core server setup
 type Core struct {
-	Hostname string
-	Port     string
-	Jsonp    bool
-	Log      string
+	Hostname    string
+	Port        string
+	Jsonp       bool
+	Log         string
+	Debug       bool
+	AdminSystem string // System uri on which the admin right grants gouncer administration
 }
 
 // Ssl certificate and key config
@@ -41,20 +49,28 @@ type Ssl struct {
 
 // Backend configuration info
 type Backend struct {
-	Memcache []string
-	Cache    *memcache.Client
-	Groupdb  string
-	Userdb   string
-	Couchdb  string
-	Smtp     string
-	Sicas    string
-	Logger   *log.Logger
+	Memcache    []string
+	Cache       *memcache.Client
+	CachePrefix string // Prefix for all cache keys. Separates instances sharing a memcache cluster
+	Groupdb     string
+	Userdb      string
+	Keydb       string
+	Auditdb     string
+	Invitedb    string
+	Couchdb     string
+	Smtp        string
+	Sicas       string
+	Logger      *log.Logger
 }
 
 // Token information
 type Token struct {
-	Algorithm  string
-	Expiration int32
+	Algorithm       string
+	Expiration      int32
+	CompactSystems  int    // Store the systems list server side when it holds more systems than this. 0 disables
+	SigningSecret   string // Secret used to sign urls. Signed urls are disabled when empty
+	SignedUrlMaxAge int32  // Maximum lifetime of a signed url in seconds. 0 means no limit
+	Impersonation   int32  // Lifetime of admin impersonation tokens in seconds. Defaults to 15 minutes
 }
 
 type Info struct {
@@ -73,15 +89,33 @@ func NewServer(cfg *Config) *Server {
 	srv := &Server{Config: cfg}
 	srv.Cache = srv.NewCache(srv.Memcache)
 
+	// Optional config sections
+	if srv.KeyConfig == nil {
+		srv.KeyConfig = &KeyConfig{}
+	}
+
+	if srv.RegistrationConfig == nil {
+		srv.RegistrationConfig = &RegistrationConfig{}
+	}
+
+	if srv.PasswordPolicy == nil {
+		srv.PasswordPolicy = &PasswordPolicy{MinLength: defaultMinPasswordLength}
+	}
+
 	return srv
 }
 
 // Start sets up gouncers routes and handlers and then starts a TLS server
 func (srv *Server) Start() {
+	// Refuse to start with a cache prefix that would produce invalid memcache keys
+	if err := ValidateCachePrefix(srv.CachePrefix); err != nil {
+		log.Fatalln("Invalid cache prefix:", err)
+	}
+
 	// Confiugre CORS
 	corsRules := cors.New(cors.Options{
 		AllowedOrigins: []string{"*"},
-		AllowedMethods: []string{"POST", "GET", "HEAD", "OPTIONS", "DELETE"},
+		AllowedMethods: []string{"POST", "GET", "HEAD", "OPTIONS", "PUT", "DELETE"},
 		AllowedHeaders: []string{"Accept", "Content-Type", "Authorization", "Origin"},
 	})
 
@@ -89,21 +123,71 @@ func (srv *Server) Start() {
 		HandlerDef{[]string{"/"}, srv.InfoHandler},
 		HandlerDef{[]string{"/authenticate", "/authenticate/"}, srv.AuthenticationHandler},
 		HandlerDef{[]string{"/authorize", "/authorize/"}, srv.AuthorizationHandler},
+		HandlerDef{[]string{"/authorize/batch", "/authorize/batch/"}, srv.BatchAuthorizationHandler},
+		HandlerDef{[]string{"/systems", "/systems/"}, srv.SystemsHandler},
 		HandlerDef{[]string{"/key", "/key/"}, srv.ReadKeyHandler},
 		HandlerDef{[]string{"/reset", "/reset/"}, srv.ResetHandler},
+		HandlerDef{[]string{"/profile", "/profile/"}, srv.ProfileHandler},
+		HandlerDef{[]string{"/account/export", "/account/export/"}, srv.ExportHandler},
+	}
+
+	// If a key database is configured enable the api key routes
+	if srv.Keydb != "" {
+		handlers = append(handlers, HandlerDef{[]string{"/keys", "/keys/"}, srv.ApiKeyHandler})
+	}
+
+	// If an audit database is configured let users inspect the usage of their keys
+	if srv.Auditdb != "" {
+		handlers = append(handlers, HandlerDef{[]string{"/keys/usage", "/keys/usage/"}, srv.KeyUsageHandler})
+	}
+
+	// If an admin system is configured enable the user administration routes
+	if srv.AdminSystem != "" {
+		adminHandlers := []HandlerDef{
+			HandlerDef{[]string{"/admin/users", "/admin/users/"}, srv.UserAdminHandler},
+			HandlerDef{[]string{"/admin/impersonate", "/admin/impersonate/"}, srv.ImpersonationHandler},
+		}
+
+		handlers = append(handlers, adminHandlers...)
+	}
+
+	// Groups can be managed by their owners so the group routes are always available
+	handlers = append(handlers, HandlerDef{[]string{"/admin/groups", "/admin/groups/"}, srv.GroupAdminHandler})
+
+	// If a signing secret is configured enable the signed url routes
+	if srv.SigningSecret != "" {
+		signHandlers := []HandlerDef{
+			HandlerDef{[]string{"/sign", "/sign/"}, srv.SignHandler},
+			HandlerDef{[]string{"/verify", "/verify/"}, srv.VerifyHandler},
+		}
+
+		handlers = append(handlers, signHandlers...)
 	}
 
 	// If an smtp server is configured enable the account registration routes
 	if srv.Smtp != "" {
 		regHandlers := []HandlerDef{
 			HandlerDef{[]string{"/register", "/register/"}, srv.RegistrationHandler},
+			HandlerDef{[]string{"/register/resend", "/register/resend/"}, srv.ResendHandler},
+			HandlerDef{[]string{"/register/status", "/register/status/"}, srv.RegistrationStatusHandler},
 			HandlerDef{[]string{"/unregister", "/unregister/"}, srv.UnRegHandler},
 			HandlerDef{[]string{"/cancel", "/cancel/"}, srv.CancelationHandler},
+			HandlerDef{[]string{"/restore", "/restore/"}, srv.RestoreHandler},
 			HandlerDef{[]string{"/confirm", "/confirm/"}, srv.ConfirmationHandler},
 			HandlerDef{[]string{"/onetime", "/onetime/"}, srv.OneTimeHandler},
+			HandlerDef{[]string{"/reset/request", "/reset/request/"}, srv.PasswordRecoveryHandler},
+			HandlerDef{[]string{"/reset/confirm", "/reset/confirm/"}, srv.PasswordRecoveryHandler},
+			HandlerDef{[]string{"/approvals", "/approvals/"}, srv.ApprovalHandler},
+			HandlerDef{[]string{"/email", "/email/"}, srv.EmailChangeHandler},
+			HandlerDef{[]string{"/email/confirm", "/email/confirm/"}, srv.EmailConfirmationHandler},
 		}
 
 		handlers = append(handlers, regHandlers...)
+
+		// Invitations require a database to keep track of them
+		if srv.Invitedb != "" {
+			handlers = append(handlers, HandlerDef{[]string{"/invite", "/invite/"}, srv.InvitationHandler})
+		}
 	}
 
 	for _, h := range handlers {
@@ -121,6 +205,14 @@ func (srv *Server) Start() {
 
 	srv.Logger = log.New(logFile, "", log.Ldate|log.Ltime|log.Lshortfile)
 
+	// Make sure users can be looked up by their email address
+	if err := EnsureUserViews(srv.Backend); err != nil {
+		srv.Logger.Println("USER VIEWS:", err)
+	}
+
+	// Delete cancelled accounts once their grace period expires
+	go srv.purge()
+
 	// Attempt to start the server. On error server exits with status 1
 	if err := http.ListenAndServeTLS(srv.Port, srv.Certificate, srv.Key, nil); err != nil {
 		srv.Logger.Fatal(err)
@@ -148,6 +240,23 @@ func (srv *Server) AuthenticationHandler(w http.ResponseWriter, r *http.Request)
 	handler.Respond()
 }
 
+// SystemsHandler lists the systems (and read keys) of a token. Useful for compact tokens
+func (srv *Server) SystemsHandler(w http.ResponseWriter, r *http.Request) {
+	srv.Logger.Println("[SYSTEMS] -", r.Proto, r.Method, r.URL.Path, r.Header.Get("User-Agent"))
+	handler := srv.ConfigureHandler(w, r)
+	if r.Method == "GET" {
+		authenticator := NewAuthenticator(handler)
+		authenticator.Backend = srv.Backend
+		authenticator.Token = srv.Token
+
+		authenticator.HandleSystemsRequest()
+	} else {
+		handler.NewError(http.StatusMethodNotAllowed, "Allowed methods for this endpoint: [GET]")
+	}
+
+	handler.Respond()
+}
+
 func (srv *Server) OneTimeHandler(w http.ResponseWriter, r *http.Request) {
 	srv.Logger.Println("[ONETIME] -", r.Proto, r.Method, r.URL.Path, r.Header.Get("User-Agent"))
 	handler := srv.ConfigureHandler(w, r)
@@ -174,6 +283,8 @@ func (srv *Server) AuthorizationHandler(w http.ResponseWriter, r *http.Request)
 		authorizer := NewAuthorizer(handler)
 		authorizer.Backend = srv.Backend
 		authorizer.Expiration = srv.Expiration
+		authorizer.Debug = srv.Debug
+		authorizer.ExplainSystem = srv.AdminSystem
 
 		// Handle authorization
 		authorizer.AuthorizeRequest()
@@ -184,6 +295,25 @@ func (srv *Server) AuthorizationHandler(w http.ResponseWriter, r *http.Request)
 	handler.Respond()
 }
 
+// BatchAuthorizationHandler delegates a list of systems to the authorizer in a single request
+func (srv *Server) BatchAuthorizationHandler(w http.ResponseWriter, r *http.Request) {
+	srv.Logger.Println("[AUTHORIZATION-BATCH]", r.Proto, r.Method, r.URL.Path, r.Header.Get("User-Agent"))
+	handler := srv.ConfigureHandler(w, r)
+	if r.Method == "POST" {
+		// Configure the Authorizer
+		authorizer := NewAuthorizer(handler)
+		authorizer.Backend = srv.Backend
+		authorizer.Expiration = srv.Expiration
+
+		// Handle batch authorization
+		authorizer.AuthorizeBatch()
+	} else {
+		handler.NewError(http.StatusMethodNotAllowed, "Allowed methods for this endpoint: [POST]")
+	}
+
+	handler.Respond()
+}
+
 func (srv *Server) ReadKeyHandler(w http.ResponseWriter, r *http.Request) {
 	srv.Logger.Println("[READ-KEY]", r.Proto, r.Method, r.URL.Path, r.Header.Get("User-Agent"))
 	handler := srv.ConfigureHandler(w, r)
@@ -191,6 +321,7 @@ func (srv *Server) ReadKeyHandler(w http.ResponseWriter, r *http.Request) {
 		// Configure the Key Handler
 		key := NewKeyHandler(handler)
 		key.Backend = srv.Backend
+		key.KeyConfig = srv.KeyConfig
 
 		key.HandleRequest()
 	} else {
@@ -200,6 +331,74 @@ func (srv *Server) ReadKeyHandler(w http.ResponseWriter, r *http.Request) {
 	handler.Respond()
 }
 
+// KeyUsageHandler lists the audited key validations for the keys of the caller
+func (srv *Server) KeyUsageHandler(w http.ResponseWriter, r *http.Request) {
+	srv.Logger.Println("[KEY-USAGE] -", r.Proto, r.Method, r.URL.Path, r.Header.Get("User-Agent"))
+	handler := srv.ConfigureHandler(w, r)
+	if r.Method == "GET" {
+		key := NewKeyHandler(handler)
+		key.Backend = srv.Backend
+		key.Credentials.Backend = srv.Backend
+
+		key.HandleUsageRequest()
+	} else {
+		handler.NewError(http.StatusMethodNotAllowed, "Allowed methods for this endpoint: [GET]")
+	}
+
+	handler.Respond()
+}
+
+// ApiKeyHandler lets users create (POST), list (GET) and revoke (DELETE /keys/<id>) their api keys
+func (srv *Server) ApiKeyHandler(w http.ResponseWriter, r *http.Request) {
+	srv.Logger.Println("[API-KEY] -", r.Proto, r.Method, r.URL.Path, r.Header.Get("User-Agent"))
+	handler := srv.ConfigureHandler(w, r)
+	if r.Method == "GET" || r.Method == "POST" || r.Method == "DELETE" {
+		keys := NewApiKeyHandler(handler)
+		keys.Backend = srv.Backend
+
+		keys.HandleRequest()
+	} else {
+		handler.NewError(http.StatusMethodNotAllowed, "Allowed methods for this endpoint: [GET, POST, DELETE]")
+	}
+
+	handler.Respond()
+}
+
+// SignHandler mints a signed url for a system the caller has access to
+func (srv *Server) SignHandler(w http.ResponseWriter, r *http.Request) {
+	srv.Logger.Println("[SIGN] -", r.Proto, r.Method, r.URL.Path, r.Header.Get("User-Agent"))
+	handler := srv.ConfigureHandler(w, r)
+	if r.Method == "POST" {
+		signer := NewUrlSigner(handler)
+		signer.Backend = srv.Backend
+		signer.Expiration = srv.Expiration
+		signer.SigningSecret = srv.SigningSecret
+		signer.MaxAge = srv.SignedUrlMaxAge
+
+		signer.Sign()
+	} else {
+		handler.NewError(http.StatusMethodNotAllowed, "Allowed methods for this endpoint: [POST]")
+	}
+
+	handler.Respond()
+}
+
+// VerifyHandler checks the signature of a signed url
+func (srv *Server) VerifyHandler(w http.ResponseWriter, r *http.Request) {
+	srv.Logger.Println("[VERIFY] -", r.Proto, r.Method, r.URL.Path, r.Header.Get("User-Agent"))
+	handler := srv.ConfigureHandler(w, r)
+	if r.Method == "POST" {
+		signer := NewUrlSigner(handler)
+		signer.SigningSecret = srv.SigningSecret
+
+		signer.Verify()
+	} else {
+		handler.NewError(http.StatusMethodNotAllowed, "Allowed methods for this endpoint: [POST]")
+	}
+
+	handler.Respond()
+}
+
 func (srv *Server) ResetHandler(w http.ResponseWriter, r *http.Request) {
 	srv.Logger.Println("[RESET] -", r.Proto, r.Method, r.URL.Path, r.Header.Get("User-Agent"))
 	handler := srv.ConfigureHandler(w, r)
@@ -208,6 +407,7 @@ func (srv *Server) ResetHandler(w http.ResponseWriter, r *http.Request) {
 		// Configure the ResetHandler
 		reset := NewResetHandler(handler)
 		reset.Backend = srv.Backend
+		reset.PasswordPolicy = srv.PasswordPolicy
 
 		// Handle reset
 		reset.UserPassword()
@@ -218,6 +418,99 @@ func (srv *Server) ResetHandler(w http.ResponseWriter, r *http.Request) {
 	handler.Respond()
 }
 
+// ProfileHandler lets users view (GET) and update (POST) their profile
+func (srv *Server) ProfileHandler(w http.ResponseWriter, r *http.Request) {
+	srv.Logger.Println("[PROFILE] -", r.Proto, r.Method, r.URL.Path, r.Header.Get("User-Agent"))
+	handler := srv.ConfigureHandler(w, r)
+
+	if r.Method == "GET" || r.Method == "POST" {
+		profile := NewProfile(handler)
+		profile.Backend = srv.Backend
+		profile.Schema = srv.Profile
+
+		profile.HandleRequest()
+	} else {
+		handler.NewError(http.StatusMethodNotAllowed, "Allowed methods for this endpoint: [GET, POST]")
+	}
+
+	handler.Respond()
+}
+
+// ExportHandler responds with an archive of all data stored about the account
+func (srv *Server) ExportHandler(w http.ResponseWriter, r *http.Request) {
+	srv.Logger.Println("[EXPORT] -", r.Proto, r.Method, r.URL.Path, r.Header.Get("User-Agent"))
+	handler := srv.ConfigureHandler(w, r)
+
+	if r.Method == "GET" {
+		export := NewAccountExport(handler)
+		export.Backend = srv.Backend
+		export.Core = srv.Core
+
+		export.HandleRequest()
+	} else {
+		handler.NewError(http.StatusMethodNotAllowed, "Allowed methods for this endpoint: [GET]")
+	}
+
+	handler.Respond()
+}
+
+// UserAdminHandler lets admins manage user accounts
+func (srv *Server) UserAdminHandler(w http.ResponseWriter, r *http.Request) {
+	srv.Logger.Println("[ADMIN USERS] -", r.Proto, r.Method, r.URL.Path, r.Header.Get("User-Agent"))
+	handler := srv.ConfigureHandler(w, r)
+
+	if r.Method == "GET" || r.Method == "POST" || r.Method == "PUT" || r.Method == "DELETE" {
+		admin := NewUserAdmin(handler)
+		admin.Backend = srv.Backend
+		admin.Core = srv.Core
+		admin.MailConfig = srv.MailConfig
+		admin.PasswordPolicy = srv.PasswordPolicy
+
+		admin.HandleRequest()
+	} else {
+		handler.NewError(http.StatusMethodNotAllowed, "Allowed methods for this endpoint: [GET, POST, PUT, DELETE]")
+	}
+
+	handler.Respond()
+}
+
+// ImpersonationHandler lets admins request a short lived token for another user
+func (srv *Server) ImpersonationHandler(w http.ResponseWriter, r *http.Request) {
+	srv.Logger.Println("[IMPERSONATION] -", r.Proto, r.Method, r.URL.Path, r.Header.Get("User-Agent"))
+	handler := srv.ConfigureHandler(w, r)
+
+	if r.Method == "POST" {
+		impersonation := NewImpersonation(handler)
+		impersonation.Backend = srv.Backend
+		impersonation.Core = srv.Core
+		impersonation.Token = srv.Token
+
+		impersonation.HandleRequest()
+	} else {
+		handler.NewError(http.StatusMethodNotAllowed, "Allowed methods for this endpoint: [POST]")
+	}
+
+	handler.Respond()
+}
+
+// GroupAdminHandler lets admins and group owners manage groups and their members
+func (srv *Server) GroupAdminHandler(w http.ResponseWriter, r *http.Request) {
+	srv.Logger.Println("[ADMIN GROUPS] -", r.Proto, r.Method, r.URL.Path, r.Header.Get("User-Agent"))
+	handler := srv.ConfigureHandler(w, r)
+
+	if r.Method == "GET" || r.Method == "POST" || r.Method == "PUT" || r.Method == "DELETE" {
+		admin := NewGroupAdmin(handler)
+		admin.Backend = srv.Backend
+		admin.Core = srv.Core
+
+		admin.HandleRequest()
+	} else {
+		handler.NewError(http.StatusMethodNotAllowed, "Allowed methods for this endpoint: [GET, POST, PUT, DELETE]")
+	}
+
+	handler.Respond()
+}
+
 // RegistrationHandler receives a regestration request and initiates the registration process
 func (srv *Server) RegistrationHandler(w http.ResponseWriter, r *http.Request) {
 	srv.Logger.Println("[REGISTRATION] -", r.Proto, r.Method, r.URL.Path, r.Header.Get("User-Agent"))
@@ -228,6 +521,9 @@ func (srv *Server) RegistrationHandler(w http.ResponseWriter, r *http.Request) {
 		registration.Backend = srv.Backend
 		registration.Groups = srv.Registrations
 		registration.MailConfig = srv.MailConfig
+		registration.RegistrationConfig = srv.RegistrationConfig
+		registration.Schema = srv.Profile
+		registration.PasswordPolicy = srv.PasswordPolicy
 		registration.Submit()
 	} else {
 		handler.NewError(http.StatusMethodNotAllowed, "Allowed methods for this endpoint: [POST]")
@@ -236,6 +532,133 @@ func (srv *Server) RegistrationHandler(w http.ResponseWriter, r *http.Request) {
 	handler.Respond()
 }
 
+// ResendHandler mails the confirmation code of a pending registration again
+func (srv *Server) ResendHandler(w http.ResponseWriter, r *http.Request) {
+	srv.Logger.Println("[RESEND] -", r.Proto, r.Method, r.URL.Path, r.Header.Get("User-Agent"))
+	handler := srv.ConfigureHandler(w, r)
+	if r.Method == "POST" {
+		registration := NewRegistration(handler)
+		registration.Core = srv.Core
+		registration.Backend = srv.Backend
+		registration.MailConfig = srv.MailConfig
+		registration.RegistrationConfig = srv.RegistrationConfig
+		registration.Resend()
+	} else {
+		handler.NewError(http.StatusMethodNotAllowed, "Allowed methods for this endpoint: [POST]")
+	}
+
+	handler.Respond()
+}
+
+// RegistrationStatusHandler responds with the state of a pending registration
+func (srv *Server) RegistrationStatusHandler(w http.ResponseWriter, r *http.Request) {
+	srv.Logger.Println("[REGISTRATION STATUS] -", r.Proto, r.Method, r.URL.Path, r.Header.Get("User-Agent"))
+	handler := srv.ConfigureHandler(w, r)
+	if r.Method == "GET" {
+		registration := NewRegistration(handler)
+		registration.Backend = srv.Backend
+		registration.Status()
+	} else {
+		handler.NewError(http.StatusMethodNotAllowed, "Allowed methods for this endpoint: [GET]")
+	}
+
+	handler.Respond()
+}
+
+// EmailChangeHandler starts an email address change for the authenticated user
+func (srv *Server) EmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	srv.Logger.Println("[EMAIL CHANGE] -", r.Proto, r.Method, r.URL.Path, r.Header.Get("User-Agent"))
+	handler := srv.ConfigureHandler(w, r)
+	if r.Method == "POST" {
+		change := NewEmailChange(handler)
+		change.Backend = srv.Backend
+		change.Core = srv.Core
+		change.MailConfig = srv.MailConfig
+		change.Registrations = srv.Registrations
+		change.Request()
+	} else {
+		handler.NewError(http.StatusMethodNotAllowed, "Allowed methods for this endpoint: [POST]")
+	}
+
+	handler.Respond()
+}
+
+// EmailConfirmationHandler completes an email address change
+func (srv *Server) EmailConfirmationHandler(w http.ResponseWriter, r *http.Request) {
+	srv.Logger.Println("[EMAIL CONFIRMATION] -", r.Proto, r.Method, r.URL.Path, r.Header.Get("User-Agent"))
+	handler := srv.ConfigureHandler(w, r)
+	if r.Method == "GET" {
+		change := NewEmailChange(handler)
+		change.Backend = srv.Backend
+		change.Core = srv.Core
+		change.MailConfig = srv.MailConfig
+		change.Confirm()
+	} else {
+		handler.NewError(http.StatusMethodNotAllowed, "Allowed methods for this endpoint: [GET]")
+	}
+
+	handler.Respond()
+}
+
+// PasswordRecoveryHandler mails reset codes (/reset/request) and sets new passwords with them (/reset/confirm)
+func (srv *Server) PasswordRecoveryHandler(w http.ResponseWriter, r *http.Request) {
+	srv.Logger.Println("[PASSWORD RECOVERY] -", r.Proto, r.Method, r.URL.Path, r.Header.Get("User-Agent"))
+	handler := srv.ConfigureHandler(w, r)
+	if r.Method == "POST" {
+		recovery := NewPasswordRecovery(handler)
+		recovery.Backend = srv.Backend
+		recovery.Core = srv.Core
+		recovery.MailConfig = srv.MailConfig
+		recovery.PasswordPolicy = srv.PasswordPolicy
+
+		if strings.HasPrefix(r.URL.Path, "/reset/confirm") {
+			recovery.Confirm()
+		} else {
+			recovery.Request()
+		}
+	} else {
+		handler.NewError(http.StatusMethodNotAllowed, "Allowed methods for this endpoint: [POST]")
+	}
+
+	handler.Respond()
+}
+
+// InvitationHandler lets admins and group owners invite new users
+func (srv *Server) InvitationHandler(w http.ResponseWriter, r *http.Request) {
+	srv.Logger.Println("[INVITATION] -", r.Proto, r.Method, r.URL.Path, r.Header.Get("User-Agent"))
+	handler := srv.ConfigureHandler(w, r)
+	if r.Method == "POST" {
+		inviter := NewInviter(handler)
+		inviter.Backend = srv.Backend
+		inviter.Core = srv.Core
+		inviter.MailConfig = srv.MailConfig
+		inviter.RegistrationConfig = srv.RegistrationConfig
+		inviter.Invite()
+	} else {
+		handler.NewError(http.StatusMethodNotAllowed, "Allowed methods for this endpoint: [POST]")
+	}
+
+	handler.Respond()
+}
+
+// ApprovalHandler lists (GET), approves (POST) and rejects (DELETE) accounts awaiting approval
+func (srv *Server) ApprovalHandler(w http.ResponseWriter, r *http.Request) {
+	srv.Logger.Println("[APPROVAL] -", r.Proto, r.Method, r.URL.Path, r.Header.Get("User-Agent"))
+	handler := srv.ConfigureHandler(w, r)
+	if r.Method == "GET" || r.Method == "POST" || r.Method == "DELETE" {
+		approval := NewApproval(handler)
+		approval.Backend = srv.Backend
+		approval.Core = srv.Core
+		approval.MailConfig = srv.MailConfig
+		approval.Registrations = srv.Registrations
+		approval.HandleRequest()
+	} else {
+		handler.NewError(http.StatusMethodNotAllowed, "Allowed methods for this endpoint: [GET, POST, DELETE]")
+	}
+
+	handler.Respond()
+}
+
 // UnregHandler allows a user to unregister by sending a delete request with valid auth information
 func (srv *Server) UnRegHandler(w http.ResponseWriter, r *http.Request) {
 	srv.Logger.Println("[UN-REGISTER] -", r.Proto, r.Method, r.URL.Path, r.Header.Get("User-Agent"))
@@ -260,6 +683,9 @@ func (srv *Server) CancelationHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
 		cancellation := NewCancellation(handler)
 		cancellation.Backend = srv.Backend
+		cancellation.Core = srv.Core
+		cancellation.MailConfig = srv.MailConfig
+		cancellation.RegistrationConfig = srv.RegistrationConfig
 		cancellation.Confirm()
 	} else {
 		handler.NewError(http.StatusMethodNotAllowed, "Allowed methods for this endpoint: [GET]")
@@ -268,6 +694,21 @@ func (srv *Server) CancelationHandler(w http.ResponseWriter, r *http.Request) {
 	handler.Respond()
 }
 
+// RestoreHandler reactivates a cancelled account within its grace period
+func (srv *Server) RestoreHandler(w http.ResponseWriter, r *http.Request) {
+	srv.Logger.Println("[RESTORE] -", r.Proto, r.Method, r.URL.Path, r.Header.Get("User-Agent"))
+	handler := srv.ConfigureHandler(w, r)
+	if r.Method == "GET" {
+		cancellation := NewCancellation(handler)
+		cancellation.Backend = srv.Backend
+		cancellation.Restore()
+	} else {
+		handler.NewError(http.StatusMethodNotAllowed, "Allowed methods for this endpoint: [GET]")
+	}
+
+	handler.Respond()
+}
+
 // ConfirmationHandler receives a confirmation request and initiates the confirmation sequence
 func (srv *Server) ConfirmationHandler(w http.ResponseWriter, r *http.Request) {
 	srv.Logger.Println("[CONFIRMATION] -", r.Proto, r.Method, r.URL.Path, r.Header.Get("User-Agent"))
@@ -275,6 +716,9 @@ func (srv *Server) ConfirmationHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
 		confirm := NewConfirm(handler)
 		confirm.Backend = srv.Backend
+		confirm.Core = srv.Core
+		confirm.MailConfig = srv.MailConfig
+		confirm.Registrations = srv.Registrations
 		confirm.Registration()
 	} else {
 		handler.NewError(http.StatusMethodNotAllowed, "Allowed methods for this endpoint: [GET]")
@@ -283,6 +727,22 @@ func (srv *Server) ConfirmationHandler(w http.ResponseWriter, r *http.Request) {
 	handler.Respond()
 }
 
+// purge periodically deletes the cancelled accounts whose grace period expired
+func (srv *Server) purge() {
+	interval := time.Duration(srv.PurgeInterval) * time.Second
+	if interval <= 0 {
+		interval = defaultPurgeInterval * time.Second
+	}
+
+	for range time.Tick(interval) {
+		if purged, err := PurgeCancelledAccounts(srv.Backend); err != nil {
+			srv.Logger.Println("PURGE:", err)
+		} else if purged > 0 {
+			srv.Logger.Println("PURGE: Deleted", purged, "cancelled accounts")
+		}
+	}
+}
+
 // NewCache starts a new memcache client for the provided servers
 func (srv *Server) NewCache(servers []string) *memcache.Client {
 	return memcache.New(servers...)
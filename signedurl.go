@@ -0,0 +1,217 @@
+package gouncer
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	expiresParam   = "expires"
+	rightsParam    = "rights"
+	signatureParam = "signature"
+)
+
+// UrlSigner mints and verifies HMAC signed urls
+type UrlSigner struct {
+	Authorizer
+	SigningSecret string // Secret used for the HMAC signatures
+	MaxAge        int32  // Maximum lifetime of a signed url in seconds. 0 means no limit
+}
+
+// SignRequest holds the system to sign a url for
+type SignRequest struct {
+	System    string   `json:"system"`
+	Rights    []string `json:"rights,omitempty"`     // Defaults to read
+	ExpiresIn int32    `json:"expires_in,omitempty"` // Lifetime in seconds. Defaults to the token expiration
+}
+
+// VerifyRequest holds a signed url to verify
+type VerifyRequest struct {
+	Url string `json:"url"`
+}
+
+func NewUrlSigner(h *ResponseHandler) *UrlSigner {
+	return &UrlSigner{Authorizer: Authorizer{ResponseHandler: h}}
+}
+
+// Sign checks that the caller can access the system with the requested rights and responds with the signed url
+func (u *UrlSigner) Sign() {
+	err := u.ParseAuthHeader(u.HttpRequest.Header.Get("Authorization"))
+
+	if err == nil {
+		var req SignRequest
+
+		if err = DecodeJsonRequest(u.HttpRequest.Body, &req); err == nil {
+			u.signRequest(req)
+		}
+	}
+
+	if err != nil {
+		u.NewError(http.StatusUnauthorized, err.Error())
+	}
+}
+
+func (u *UrlSigner) signRequest(req SignRequest) {
+	var accessList []interface{}
+
+	valid, err := u.ValidCredentials()
+
+	if valid {
+		accessList, err = u.AccessList()
+	} else if err == nil {
+		err = errors.New("Invalid credentials")
+	}
+
+	if err != nil {
+		u.NewError(http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	// Signed urls outlive the token and carry no actor, so impersonation tokens can't sign
+	if u.Impersonated() {
+		u.NewError(http.StatusForbidden, "Impersonation tokens can't be used to sign urls")
+		u.audit(req, errors.New(u.Response.Error))
+		return
+	}
+
+	if len(req.Rights) == 0 {
+		req.Rights = []string{"read"}
+	}
+
+	entry, match := u.MatchEntry(req.System, accessList)
+	if !match {
+		u.NewError(http.StatusForbidden, "You do not have access to this system")
+		return
+	}
+
+	if PolicyGuarded(entry) {
+		u.NewError(http.StatusForbidden, "Urls can't be signed for this system because access is restricted by a policy")
+		return
+	}
+
+	for _, right := range req.Rights {
+		if !containsRight(entry["rights"], right) {
+			u.NewError(http.StatusForbidden, "You do not have the "+right+" right on this system")
+			return
+		}
+	}
+
+	lifetime := u.Expiration
+	if req.ExpiresIn > 0 {
+		lifetime = req.ExpiresIn
+	}
+
+	if u.MaxAge > 0 && lifetime > u.MaxAge {
+		lifetime = u.MaxAge
+	}
+
+	signed, err := SignURL(req.System, req.Rights, time.Now().Add(time.Duration(lifetime)*time.Second), []byte(u.SigningSecret))
+	u.audit(req, err)
+
+	if err != nil {
+		u.NewError(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	u.Response.Status = http.StatusOK
+	u.Response.Url = signed
+}
+
+// audit records the signing request in the audit database
+func (u *UrlSigner) audit(req SignRequest, err error) {
+	event := NewAuditEvent("sign", u.HttpRequest)
+	event.Owner = u.Username
+	event.System = req.System
+	event.Success = err == nil
+	u.MarkActor(event)
+
+	if err != nil {
+		event.Error = err.Error()
+	}
+
+	u.Audit(event)
+}
+
+// Verify checks the signature and expiry of a signed url and responds with the rights it grants
+func (u *UrlSigner) Verify() {
+	var req VerifyRequest
+
+	if err := DecodeJsonRequest(u.HttpRequest.Body, &req); err != nil {
+		u.NewError(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if rights, err := VerifySignedURL(req.Url, []byte(u.SigningSecret)); err == nil {
+		u.Response.Status = http.StatusOK
+		u.Response.AccessRights = rights
+	} else {
+		u.NewError(http.StatusUnauthorized, err.Error())
+	}
+}
+
+// SignURL adds the expires, rights and signature query parameters to the url. The signature
+// is a HMAC-SHA256 over the url with its query parameters in sorted order.
+func SignURL(rawurl string, rights []string, expires time.Time, secret []byte) (string, error) {
+	if len(secret) == 0 {
+		return "", errors.New("No signing secret configured")
+	}
+
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Host == "" {
+		return "", errors.New("Invalid system url")
+	}
+
+	query := u.Query()
+	query.Del(signatureParam)
+	query.Set(expiresParam, strconv.FormatInt(expires.Unix(), 10))
+	query.Set(rightsParam, strings.Join(rights, ","))
+	u.RawQuery = query.Encode()
+
+	query.Set(signatureParam, urlSignature(u, secret))
+	u.RawQuery = query.Encode()
+
+	return u.String(), nil
+}
+
+// VerifySignedURL checks the signature and expiry of a signed url without any backend lookups
+// and returns the rights the url grants. Services holding the signing secret can call it directly.
+func VerifySignedURL(rawurl string, secret []byte) ([]string, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("No signing secret configured")
+	}
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, errors.New("Invalid url")
+	}
+
+	query := u.Query()
+	signature := query.Get(signatureParam)
+
+	query.Del(signatureParam)
+	u.RawQuery = query.Encode()
+
+	if signature == "" || !hmac.Equal([]byte(signature), []byte(urlSignature(u, secret))) {
+		return nil, errors.New("Invalid signature")
+	}
+
+	expires, err := strconv.ParseInt(query.Get(expiresParam), 10, 64)
+	if err != nil || time.Now().Unix() >= expires {
+		return nil, errors.New("This url has expired")
+	}
+
+	return strings.Split(query.Get(rightsParam), ","), nil
+}
+
+func urlSignature(u *url.URL, secret []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(u.Scheme + "://" + u.Host + u.EscapedPath() + "?" + u.RawQuery))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
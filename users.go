@@ -0,0 +1,236 @@
+package gouncer
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+const (
+	userDesign = "gouncer"  // Design document holding the user views
+	emailView  = "by_email" // View mapping lowercased email addresses to user documents
+	groupView  = "by_group" // View mapping group ids to the user documents of their members
+	userPrefix = "u-"       // Prefix of the opaque user ids
+)
+
+var errUserNotFound = errors.New("404 Object Not Found")
+var errUserExists = errors.New("This user already exists.")
+var errDuplicateUser = errors.New("Multiple accounts use this email address. Please contact the administrator.")
+
+// userDesignDoc indexes the user documents on their email address
+var userDesignDoc = map[string]interface{}{
+	"_id":      "_design/" + userDesign,
+	"language": "javascript",
+	"views": map[string]interface{}{
+		emailView: map[string]interface{}{
+			"map": "function(doc) { if (doc.email) { emit(doc.email.toLowerCase(), null); } }",
+		},
+		groupView: map[string]interface{}{
+			"map": "function(doc) { if (doc.groups) { doc.groups.forEach(function(g) { emit(typeof g === 'string' ? g : g.id, null); }); } }",
+		},
+	},
+}
+
+// NewUserID generates a random opaque user id. It never changes, so unlike the
+// email address it can be used as a stable reference to the user (sub claim).
+func NewUserID() string {
+	return userPrefix + randomHex(16)
+}
+
+// randomHex returns size bytes from crypto/rand hex encoded. Use it for ids, codes and
+// secrets that have to be unguessable. CharSalt and TimeSalt are not.
+func randomHex(size int) string {
+	b := make([]byte, size)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// EnsureUserViews installs or updates the design document with the user lookup views
+func EnsureUserViews(backend *Backend) error {
+	couch := NewCouch(backend.Couchdb, backend.Userdb)
+	design := make(map[string]interface{})
+
+	for k, v := range userDesignDoc {
+		design[k] = v
+	}
+
+	if current, err := couch.Get(design["_id"].(string)); err == nil {
+		if viewsMatch(current["views"], design["views"]) {
+			return nil
+		}
+
+		design["_rev"] = current["_rev"]
+	}
+
+	doc, err := json.Marshal(design)
+
+	if err == nil {
+		_, err = couch.Post(doc)
+	}
+
+	return err
+}
+
+// viewsMatch compares the installed views with the expected ones
+func viewsMatch(installed interface{}, expected interface{}) bool {
+	a, errA := json.Marshal(installed)
+	b, errB := json.Marshal(expected)
+
+	return errA == nil && errB == nil && string(a) == string(b)
+}
+
+// GroupMembers looks up the user documents of the members of the group through the group view
+func GroupMembers(backend *Backend, group string) ([]interface{}, error) {
+	return NewCouch(backend.Couchdb, backend.Userdb).View(userDesign, groupView, group)
+}
+
+// FetchUserByEmail looks the user up through the email view. When the view isn't available
+// it falls back to documents that still use the email address as id.
+func FetchUserByEmail(backend *Backend, email string) (map[string]interface{}, error) {
+	email = strings.ToLower(email)
+	couch := NewCouch(backend.Couchdb, backend.Userdb)
+
+	docs, err := couch.View(userDesign, emailView, email)
+
+	if err != nil {
+		doc, gerr := couch.Get(email)
+		if gerr != nil && gerr.Error() == errUserNotFound.Error() {
+			gerr = errUserNotFound
+		}
+
+		return doc, gerr
+	}
+
+	if len(docs) == 0 {
+		return nil, errUserNotFound
+	}
+
+	// Never guess which account was meant
+	if len(docs) > 1 {
+		backend.Logger.Println("USER LOOKUP: Multiple accounts for", email)
+		return nil, errDuplicateUser
+	}
+
+	doc, _ := docs[0].(map[string]interface{})
+	return doc, nil
+}
+
+// FetchUserByID loads the user document with the stable user id (sub claim). Ids that don't
+// look like user ids never reach the database.
+func FetchUserByID(backend *Backend, id string) (map[string]interface{}, error) {
+	hexID := strings.TrimPrefix(id, userPrefix)
+
+	if hexID == id || hexID == "" || strings.Trim(hexID, "0123456789abcdef") != "" {
+		return nil, errUserNotFound
+	}
+
+	doc, err := NewCouch(backend.Couchdb, backend.Userdb).Get(id)
+	if err != nil && err.Error() == errUserNotFound.Error() {
+		err = errUserNotFound
+	}
+
+	return doc, err
+}
+
+// ClaimEmail checks after a write that no other account uses the email address. CouchDB only
+// enforces unique ids, so two writes can race past the UserExists check. When that happens the
+// account with the lowest id keeps the address and the other writer gets errUserExists and has
+// to undo its write.
+func ClaimEmail(backend *Backend, email string, id string) error {
+	docs, err := NewCouch(backend.Couchdb, backend.Userdb).View(userDesign, emailView, strings.ToLower(email))
+
+	if err != nil {
+		return err
+	}
+
+	for _, d := range docs {
+		if other, _ := d.(map[string]interface{})["_id"].(string); other < id {
+			return errUserExists
+		}
+	}
+
+	return nil
+}
+
+// UserExists checks if an account for the email address exists. Lookup failures other than
+// a missing account are returned as an error.
+func UserExists(backend *Backend, email string) (bool, error) {
+	_, err := FetchUserByEmail(backend, email)
+
+	switch err {
+	case nil, errDuplicateUser:
+		return true, nil
+	case errUserNotFound:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// legacyUser checks if the user document still uses the email address as id
+func legacyUser(doc map[string]interface{}) bool {
+	id, _ := doc["_id"].(string)
+	return strings.Contains(id, "@")
+}
+
+// rekeyUser stores the user document under a new id and removes the old document. The new
+// document is removed again when the old one can't be deleted.
+func rekeyUser(couch *CouchDB, doc map[string]interface{}, id string) error {
+	old, _ := doc["_id"].(string)
+
+	doc["_id"] = id
+	delete(doc, "_rev")
+
+	data, err := json.Marshal(doc)
+
+	if err == nil {
+		_, err = couch.Post(data)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if _, err = couch.Delete(old); err != nil {
+		couch.Delete(id)
+	}
+
+	return err
+}
+
+// MigrateUserIDs converts user documents that use the email address as id to opaque user ids.
+// It returns the number of migrated documents.
+func MigrateUserIDs(backend *Backend) (int, error) {
+	couch := NewCouch(backend.Couchdb, backend.Userdb)
+	docs, err := couch.AllDocs()
+
+	if err != nil {
+		return 0, err
+	}
+
+	var migrated int
+
+	for _, d := range docs {
+		doc, ok := d.(map[string]interface{})
+		if !ok || !legacyUser(doc) {
+			continue
+		}
+
+		id, _ := doc["_id"].(string)
+
+		if _, exists := doc["email"]; !exists {
+			doc["email"] = strings.ToLower(id)
+		}
+
+		if err = rekeyUser(couch, doc, NewUserID()); err != nil {
+			backend.Logger.Println("USER MIGRATION:", id, err)
+			continue
+		}
+
+		migrated++
+	}
+
+	return migrated, nil
+}